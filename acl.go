@@ -0,0 +1,78 @@
+package sudp
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// ACL restricts what an authenticated peer is allowed to do. Empty fields do
+// not restrict anything.
+type ACL struct {
+	Vaddrs  []uint16     // Reachable destinations, the server virtual address included
+	Ports   []uint16     // Allowed channels, DefaultPort included
+	MaxSize int          // Max message size in bytes
+	Sources []*net.IPNet // Allowed source networks of the peer
+}
+
+type ACLConfig struct {
+	AllowVaddrs    []int    `json:"allow_vaddrs,omitempty"`
+	AllowPorts     []int    `json:"allow_ports,omitempty"`
+	MaxMessageSize int      `json:"max_message_size,omitempty"`
+	AllowSources   []string `json:"allow_sources,omitempty"`
+}
+
+func (config *ACLConfig) acl() (*ACL, error) {
+	acl := ACL{
+		MaxSize: config.MaxMessageSize,
+	}
+	for _, v := range config.AllowVaddrs {
+		if v < 0 || v > 0xffff {
+			return nil, fmt.Errorf("invalid virtual address %d in allow_vaddrs", v)
+		}
+		acl.Vaddrs = append(acl.Vaddrs, uint16(v))
+	}
+	for _, p := range config.AllowPorts {
+		if p < 0 || p > 0xffff {
+			return nil, fmt.Errorf("invalid port %d in allow_ports", p)
+		}
+		acl.Ports = append(acl.Ports, uint16(p))
+	}
+	for _, s := range config.AllowSources {
+		_, n, e := net.ParseCIDR(s)
+		if e != nil {
+			return nil, fmt.Errorf("invalid network in allow_sources: %v", e)
+		}
+		acl.Sources = append(acl.Sources, n)
+	}
+	return &acl, nil
+}
+
+func (a *ACL) allowSource(addr *net.UDPAddr) bool {
+	if a == nil || len(a.Sources) == 0 {
+		return true
+	}
+	for _, n := range a.Sources {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMessage returns the reason why msg is not allowed, or nil.
+func (a *ACL) allowMessage(msg *message) error {
+	if a == nil {
+		return nil
+	}
+	if len(a.Vaddrs) > 0 && !slices.Contains(a.Vaddrs, msg.dst) {
+		return fmt.Errorf("destination %d not allowed", msg.dst)
+	}
+	if len(a.Ports) > 0 && !slices.Contains(a.Ports, msg.port) {
+		return fmt.Errorf("port %d not allowed", msg.port)
+	}
+	if a.MaxSize > 0 && len(msg.buff) > a.MaxSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrMessageTooLarge, len(msg.buff), a.MaxSize)
+	}
+	return nil
+}
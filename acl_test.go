@@ -0,0 +1,92 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+)
+
+// Each rule of a peer ACL denies what it does not allow, counting the drops.
+func TestACL(t *testing.T) {
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, c := range []struct {
+		name    string
+		acl     *ACL
+		denied  func(*ClientConn) error
+		allowed func(*ClientConn) error // Sends want to the server, nil if nothing is allowed
+		want    string
+	}{
+		{
+			name:    "vaddrs",
+			acl:     &ACL{Vaddrs: []uint16{0}},
+			denied:  func(c *ClientConn) error { return c.SendTo([]byte("to 2"), 2) },
+			allowed: func(c *ClientConn) error { return c.Send([]byte("to 0")) },
+			want:    "to 0",
+		},
+		{
+			name: "ports",
+			acl:  &ACL{Ports: []uint16{DefaultPort}},
+			denied: func(c *ClientConn) error {
+				ch, err := c.Open(7)
+				if err != nil {
+					return err
+				}
+				return ch.Send([]byte("port 7"))
+			},
+			allowed: func(c *ClientConn) error { return c.Send([]byte("port 0")) },
+			want:    "port 0",
+		},
+		{
+			name:    "max size",
+			acl:     &ACL{MaxSize: 4},
+			denied:  func(c *ClientConn) error { return c.Send([]byte("12345")) },
+			allowed: func(c *ClientConn) error { return c.Send([]byte("1234")) },
+			want:    "1234",
+		},
+		{
+			name:    "sources allowed",
+			acl:     &ACL{Sources: []*net.IPNet{other, local}},
+			allowed: func(c *ClientConn) error { return c.Send([]byte("from 127.0.0.1")) },
+			want:    "from 127.0.0.1",
+		},
+		{
+			name:   "sources",
+			acl:    &ACL{Sources: []*net.IPNet{other}},
+			denied: func(c *ClientConn) error { return c.Send([]byte("from 127.0.0.1")) },
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv, clients, remotes := newStar(t, 2, &ServerOpts{Relay: true}, nil)
+			cli := clients[0]
+			raddr := *remotes[0]
+			raddr.ACL = c.acl
+			if err := srv.UpdatePeer(&raddr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := srv.Listen(7); err != nil {
+				t.Fatal(err)
+			}
+			if c.denied != nil {
+				if err := c.denied(cli); err != nil {
+					t.Fatal(err)
+				}
+				waitFor(t, "the denied message", func() bool { return peerDrops(t, srv, 1, DropDenied) > 0 })
+			}
+			if c.allowed != nil {
+				if err := c.allowed(cli); err != nil {
+					t.Fatal(err)
+				}
+				b, from, err := srv.RecvFrom()
+				if err != nil || string(b) != c.want || from != 1 {
+					t.Fatalf("RecvFrom = %q, %d, %v", b, from, err)
+				}
+				if c.denied == nil && peerDrops(t, srv, 1, DropDenied) != 0 {
+					t.Fatal("allowed messages denied")
+				}
+			}
+			if srv.Denied() == 0 && c.denied != nil {
+				t.Fatal("denied message not in the server totals")
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 	"net"
+	"slices"
 )
 
 // RemoteAddr represents a remote peer's address and cryptographic information.
@@ -31,6 +32,15 @@ type RemoteAddr struct {
 	PublicKey      *ecdsa.PublicKey // The peer's public key for secure communication.
 	SharedHmacKey  []byte           // Pre-shared HMAC key for message authentication.
 	NetworkAddress *net.UDPAddr     // The peer's actual network address (IP and port).
+	Endpoints      []Endpoint       // Alternative network addresses of the peer sharing its keys.
+	ACL            *ACL             // Optional restrictions applied by the server to the peer.
+}
+
+// Endpoint is an alternative network address of a peer. Endpoints with a
+// greater weight are preferred.
+type Endpoint struct {
+	NetworkAddress *net.UDPAddr
+	Weight         int
 }
 
 // LocalAddr represents the local node's address and cryptographic information.
@@ -40,6 +50,25 @@ type LocalAddr struct {
 	NetworkAddress *net.UDPAddr      // The local node's actual network address (IP and port).
 }
 
+// endpoints returns the network addresses of the peer in order of preference,
+// NetworkAddress first and then Endpoints by weight.
+func (a *RemoteAddr) endpoints() []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	if a.NetworkAddress != nil {
+		addrs = append(addrs, a.NetworkAddress)
+	}
+	alt := slices.Clone(a.Endpoints)
+	slices.SortStableFunc(alt, func(x, y Endpoint) int {
+		return y.Weight - x.Weight
+	})
+	for _, e := range alt {
+		if e.NetworkAddress != nil {
+			addrs = append(addrs, e.NetworkAddress)
+		}
+	}
+	return addrs
+}
+
 // String returns a string representation of a RemoteAddr instance.
 func (a *RemoteAddr) String() string {
 	pkok := a.PublicKey != nil
@@ -0,0 +1,424 @@
+package sudp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// batchSize is the largest number of datagrams read or written by a single
+// recvmmsg or sendmmsg.
+const batchSize = 32
+
+const (
+	groBatch    = 8     // Coalesced buffers read by a single recvmmsg
+	groBuffSize = 65535 // Largest coalesced buffer
+	gsoSegments = 64    // Largest number of segments of a single send
+	gsoMaxBytes = 65507 // Largest payload of a single send
+)
+
+// noGSO is set once a segmented send fails, the kernel or the device does not
+// support UDP_SEGMENT and packets are sent one by one from then on.
+var noGSO atomic.Bool
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn, their
+// messages are the same type.
+type batchConn interface {
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// unsupported reports whether the kernel lacks the batch system calls, the
+// caller falls back to one datagram at a time.
+func unsupported(e error) bool {
+	return errors.Is(e, syscall.ENOSYS) || errors.Is(e, syscall.EOPNOTSUPP)
+}
+
+// gsoFailed reports whether a segmented send failed because of the offload.
+func gsoFailed(e error) bool {
+	return errors.Is(e, syscall.EIO) || errors.Is(e, syscall.EINVAL) ||
+		errors.Is(e, syscall.ENOPROTOOPT) || errors.Is(e, syscall.EOPNOTSUPP)
+}
+
+// enableGRO asks the kernel to coalesce the datagrams received by conn.
+func enableGRO(conn *net.UDPConn) bool {
+	rc, e := conn.SyscallConn()
+	if e != nil {
+		return false
+	}
+	var se error
+	if e := rc.Control(func(fd uintptr) {
+		se = unix.SetsockoptInt(int(fd), unix.SOL_UDP, unix.UDP_GRO, 1)
+	}); e != nil {
+		return false
+	}
+	return se == nil
+}
+
+// groSize returns the segment size of a coalesced buffer from its control
+// message, 0 if it was not coalesced.
+func groSize(oob []byte) int {
+	for len(oob) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		if h.Len < unix.SizeofCmsghdr || uint64(h.Len) > uint64(len(oob)) {
+			return 0
+		}
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO && uint64(h.Len) >= uint64(unix.CmsgLen(4)) {
+			return int(*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])))
+		}
+		oob = oob[unix.CmsgSpace(int(h.Len)-unix.CmsgLen(0)):]
+	}
+	return 0
+}
+
+// gsoCmsg is the control message splitting a send into segments of size.
+func gsoCmsg(size int) []byte {
+	b := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = uint16(size)
+	return b
+}
+
+// mmsghdr is a message of recvmmsg, which x/sys does not wrap.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	n   uint32
+}
+
+// pktReader reads the datagrams of a connection in batches with recvmmsg,
+// into buffers and source addresses kept between calls so reading does not
+// allocate. With GRO the kernel coalesces datagrams of a flow into large
+// buffers, which are split into packets.
+type pktReader struct {
+	conn    *net.UDPConn
+	rc      syscall.RawConn
+	read    func(fd uintptr) bool // r.readmmsg
+	n       int                   // Result of the last recvmmsg
+	errno   syscall.Errno
+	from    netip.AddrPort // Only source accepted when valid
+	sources addrCache
+	batch   bool // Unset once recvmmsg is found unsupported
+	msgs    []mmsghdr
+	iovs    []unix.Iovec
+	names   []unix.RawSockaddrInet6 // Large enough for both families
+	oob     [][]byte
+	pkts    []*pktbuff // Buffers of msgs, nil once returned
+	gro     [][]byte   // Buffers of msgs with GRO
+	out     []*pktbuff
+}
+
+func newPktReader(conn *net.UDPConn, from *net.UDPAddr) *pktReader {
+	r := &pktReader{
+		conn:    conn,
+		sources: make(addrCache),
+		out:     make([]*pktbuff, 0, batchSize),
+	}
+	if from != nil {
+		ap := from.AddrPort()
+		r.from = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	rc, e := conn.SyscallConn()
+	if e != nil {
+		return r
+	}
+	r.rc = rc
+	r.read = r.readmmsg
+	r.batch = true
+	n := batchSize
+	if enableGRO(conn) {
+		n = groBatch
+		r.gro = make([][]byte, n)
+		r.oob = make([][]byte, n)
+		for i := range r.gro {
+			r.gro[i] = make([]byte, groBuffSize)
+			r.oob[i] = make([]byte, unix.CmsgSpace(4))
+		}
+	} else {
+		r.pkts = make([]*pktbuff, n)
+	}
+	r.msgs = make([]mmsghdr, n)
+	r.iovs = make([]unix.Iovec, n)
+	r.names = make([]unix.RawSockaddrInet6, n)
+	for i := range r.msgs {
+		h := &r.msgs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+		h.Iov = &r.iovs[i]
+		h.SetIovlen(1)
+		if r.gro != nil {
+			r.iovs[i].Base = &r.gro[i][0]
+			r.iovs[i].SetLen(len(r.gro[i]))
+		}
+	}
+	return r
+}
+
+// recv returns the next received packets, the slice is reused by the next
+// call.
+func (r *pktReader) recv() ([]*pktbuff, error) {
+	if !r.batch {
+		if r.gro != nil {
+			return r.recvGRO()
+		}
+		var from *net.UDPAddr
+		if r.from.IsValid() {
+			from = net.UDPAddrFromAddrPort(r.from)
+		}
+		p, e := pktRecv(r.conn, from, nil, r.sources)
+		if e != nil {
+			return nil, e
+		}
+		r.out = append(r.out[:0], p)
+		return r.out, nil
+	}
+	for i := range r.msgs {
+		if r.pkts != nil {
+			if r.pkts[i] == nil {
+				r.pkts[i] = allocPktbuff()
+			}
+			r.iovs[i].Base = &r.pkts[i].buff[0]
+			r.iovs[i].SetLen(len(r.pkts[i].buff))
+		}
+		h := &r.msgs[i].hdr
+		h.Namelen = unix.SizeofSockaddrInet6
+		if r.oob != nil {
+			h.Control = &r.oob[i][0]
+			h.SetControllen(len(r.oob[i]))
+		}
+	}
+	n, e := r.recvmmsg()
+	if e != nil {
+		if unsupported(e) {
+			r.release()
+			return r.recv()
+		}
+		return nil, e
+	}
+	r.out = r.out[:0]
+	for i := 0; i < n; i++ {
+		m := &r.msgs[i]
+		ap, ok := sockaddrPort(&r.names[i])
+		if !ok || (r.from.IsValid() && ap != r.from) {
+			continue
+		}
+		addr := r.sources.get(ap)
+		if r.gro != nil {
+			r.split(r.gro[i][:m.n], groSize(r.oob[i][:m.hdr.Controllen]), addr)
+			continue
+		}
+		p := r.pkts[i]
+		r.pkts[i] = nil
+		p.size = int(m.n)
+		p.addr = addr
+		r.out = append(r.out, p)
+	}
+	return r.out, nil
+}
+
+// recvmmsg fills the messages of r, waiting for the socket to be readable.
+func (r *pktReader) recvmmsg() (int, error) {
+	if e := r.rc.Read(r.read); e != nil {
+		return 0, e
+	}
+	if r.errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", r.errno)
+	}
+	return r.n, nil
+}
+
+// readmmsg is the read function of recvmmsg, kept in r.read so the calls do
+// not allocate a closure. It returns false to wait for the socket.
+func (r *pktReader) readmmsg(fd uintptr) bool {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.msgs[0])),
+			uintptr(len(r.msgs)), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno == unix.EAGAIN {
+			return false
+		}
+		r.n, r.errno = int(n), errno
+		return true
+	}
+}
+
+// sockaddrPort returns the unmapped address of a sockaddr filled by the kernel.
+func sockaddrPort(sa *unix.RawSockaddrInet6) (netip.AddrPort, bool) {
+	switch sa.Family {
+	case unix.AF_INET:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		return netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), uint16(port[0])<<8|uint16(port[1])), true
+	case unix.AF_INET6:
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), uint16(port[0])<<8|uint16(port[1])), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// recvGRO reads a single coalesced buffer once batches are found unsupported,
+// UDP_GRO is still on so the buffer must hold every segment.
+func (r *pktReader) recvGRO() ([]*pktbuff, error) {
+	oob := r.oob[0]
+	for {
+		n, nn, _, a, e := r.conn.ReadMsgUDPAddrPort(r.gro[0], oob)
+		if e != nil {
+			return nil, e
+		}
+		a = netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+		if r.from.IsValid() && a != r.from {
+			continue
+		}
+		r.out = r.out[:0]
+		r.split(r.gro[0][:n], groSize(oob[:nn]), r.sources.get(a))
+		return r.out, nil
+	}
+}
+
+// split copies the datagrams coalesced in b into packets, the last one may be
+// shorter than size.
+func (r *pktReader) split(b []byte, size int, addr *net.UDPAddr) {
+	if size <= 0 {
+		size = len(b)
+	}
+	for len(b) > 0 {
+		seg := b[:min(size, len(b))]
+		b = b[len(seg):]
+		p := allocPktbuff()
+		p.size = copy(p.buff, seg)
+		p.addr = addr
+		r.out = append(r.out, p)
+	}
+}
+
+// release gives back the buffers kept for the next batch and switches to
+// single reads.
+func (r *pktReader) release() {
+	for i, p := range r.pkts {
+		if p != nil {
+			p.release()
+			r.pkts[i] = nil
+		}
+	}
+	r.batch = false
+}
+
+// pktWriter writes the packets of a socket, its batch connection is built
+// once.
+type pktWriter struct {
+	conn  *net.UDPConn
+	batch batchConn
+}
+
+func newPktWriter(conn *net.UDPConn) *pktWriter {
+	return &pktWriter{conn: conn, batch: newBatchConn(conn)}
+}
+
+// send writes pkts in order with sendmmsg and returns how many were sent.
+// Consecutive packets of the same size to the same destination are sent as
+// the segments of a single datagram with UDP_SEGMENT.
+func (w *pktWriter) send(pkts []*pktbuff) (int, error) {
+	for _, p := range pkts {
+		if p.addr == nil || p.addr.IP == nil {
+			return pktSendEach(w.conn, pkts)
+		}
+	}
+	sent := 0
+	if !noGSO.Load() {
+		n, segmented, e := writeBatch(w.batch, pkts, true)
+		switch {
+		case e == nil:
+			return n, nil
+		case segmented && gsoFailed(e):
+			noGSO.Store(true)
+		case !unsupported(e):
+			return n, e
+		}
+		// Retried without segments, then one by one if sendmmsg is missing
+		sent = n
+	}
+	n, _, e := writeBatch(w.batch, pkts[sent:], false)
+	if e != nil && unsupported(e) {
+		m, e := pktSendEach(w.conn, pkts[sent+n:])
+		return sent + n + m, e
+	}
+	return sent + n, e
+}
+
+// writeBatch writes pkts with sendmmsg, segmented when gso is set. On error it
+// reports whether the failed datagram was segmented.
+func writeBatch(batch batchConn, pkts []*pktbuff, gso bool) (int, bool, error) {
+	msgs := make([]ipv4.Message, 0, min(len(pkts), batchSize))
+	counts := make([]int, 0, cap(msgs)) // Packets of each message
+	sent := 0
+	for sent < len(pkts) {
+		msgs, counts = msgs[:0], counts[:0]
+		for i := sent; i < len(pkts) && len(msgs) < batchSize; {
+			n := 1
+			if gso {
+				n = segments(pkts[i:])
+			}
+			m := ipv4.Message{Addr: pkts[i].addr, Buffers: make([][]byte, n)}
+			for j, p := range pkts[i : i+n] {
+				m.Buffers[j] = p.buff[:p.size]
+			}
+			if n > 1 {
+				m.OOB = gsoCmsg(pkts[i].size)
+			}
+			msgs = append(msgs, m)
+			counts = append(counts, n)
+			i += n
+		}
+		n, e := batch.WriteBatch(msgs, 0)
+		n = max(n, 0)
+		for _, c := range counts[:n] {
+			sent += c
+		}
+		if e != nil {
+			return sent, n < len(counts) && counts[n] > 1, e
+		}
+		if n == 0 {
+			return sent, false, io.ErrShortWrite
+		}
+	}
+	return sent, false, nil
+}
+
+// segments returns how many of the first packets can be sent as a single
+// segmented datagram: same destination and size, except the last one which
+// may be shorter.
+func segments(pkts []*pktbuff) int {
+	size := pkts[0].size
+	total := size
+	n := 1
+	for n < len(pkts) && n < gsoSegments {
+		p := pkts[n]
+		if p.size > size || total+p.size > gsoMaxBytes || !sameAddr(p.addr, pkts[0].addr) {
+			break
+		}
+		total += p.size
+		n++
+		if p.size < size {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,62 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendBatchNoGSO(t *testing.T) {
+	defer noGSO.Store(noGSO.Load())
+	noGSO.Store(true)
+	testSendBatch(t, 1000, 1000, 1000, 300)
+}
+
+// A reader falling back to single reads keeps splitting the buffers coalesced
+// by GRO.
+func TestReaderFallbackGRO(t *testing.T) {
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	r := newPktReader(rx, nil)
+	if r.gro == nil {
+		t.Skip("GRO not supported")
+	}
+	r.release()
+
+	const n, size = 16, 1000
+	pkts := make([]*pktbuff, n)
+	for i := range pkts {
+		pkts[i] = allocPktbuff()
+		pkts[i].size = size
+		pkts[i].addr = rx.LocalAddr().(*net.UDPAddr)
+		for j := range size {
+			pkts[i].buff[j] = byte(i)
+		}
+		defer pkts[i].release()
+	}
+	if m, err := newPktWriter(tx).send(pkts); err != nil || m != n {
+		t.Fatalf("send: sent %d of %d: %v", m, n, err)
+	}
+	rx.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for got := 0; got < n; {
+		out, err := r.recv()
+		if err != nil {
+			t.Fatalf("received %d of %d packets: %v", got, n, err)
+		}
+		for _, p := range out {
+			if p.size != size || p.buff[0] != byte(got) || p.buff[size-1] != byte(got) {
+				t.Fatalf("packet %d: got %d bytes of %d", got, p.size, p.buff[0])
+			}
+			p.release()
+			got++
+		}
+	}
+}
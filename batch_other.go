@@ -0,0 +1,42 @@
+//go:build !linux
+
+package sudp
+
+import "net"
+
+// pktReader reads one datagram at a time where batches are not supported.
+type pktReader struct {
+	conn    *net.UDPConn
+	from    *net.UDPAddr
+	sources addrCache
+	pkts    [1]*pktbuff
+}
+
+func newPktReader(conn *net.UDPConn, from *net.UDPAddr) *pktReader {
+	return &pktReader{conn: conn, from: from, sources: make(addrCache)}
+}
+
+// recv returns the next received packets, the slice is reused by the next
+// call.
+func (r *pktReader) recv() ([]*pktbuff, error) {
+	p, e := pktRecv(r.conn, r.from, nil, r.sources)
+	if e != nil {
+		return nil, e
+	}
+	r.pkts[0] = p
+	return r.pkts[:], nil
+}
+
+// pktWriter writes the packets of a socket one at a time.
+type pktWriter struct {
+	conn *net.UDPConn
+}
+
+func newPktWriter(conn *net.UDPConn) *pktWriter {
+	return &pktWriter{conn: conn}
+}
+
+// send writes pkts in order and returns how many were sent.
+func (w *pktWriter) send(pkts []*pktbuff) (int, error) {
+	return pktSendEach(w.conn, pkts)
+}
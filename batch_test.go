@@ -0,0 +1,66 @@
+package sudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// batch returns n messages of the given sizes, cycled, numbered from first.
+func batch(first, n int, sizes ...int) [][]byte {
+	buffs := make([][]byte, n)
+	for i := range buffs {
+		b := make([]byte, sizes[i%len(sizes)])
+		for j := range b {
+			b[j] = byte(first + i + j)
+		}
+		binary.BigEndian.PutUint32(b, uint32(first+i))
+		buffs[i] = b
+	}
+	return buffs
+}
+
+func testSendBatch(t *testing.T, sizes ...int) {
+	srv, cli := newPair(t, nil, nil)
+	const rounds, size = 8, 48
+	var want [][]byte
+	for r := range rounds {
+		buffs := batch(r*size, size, sizes...)
+		want = append(want, buffs...)
+		n, err := cli.SendBatchTo(buffs, 0)
+		if err != nil || n != len(buffs) {
+			t.Fatalf("SendBatchTo: sent %d of %d: %v", n, len(buffs), err)
+		}
+		// Leave room in the receive queue, loopback drops are not expected
+		got := recvAll(t, srv, len(buffs))
+		for i, b := range got {
+			if !bytes.Equal(b, buffs[i]) {
+				t.Fatalf("message %d: got %d bytes numbered %d, want %d bytes numbered %d",
+					r*size+i, len(b), binary.BigEndian.Uint32(b), len(buffs[i]), r*size+i)
+			}
+		}
+	}
+	st, err := cli.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TxPackets < uint64(len(want)) {
+		t.Errorf("TxPackets = %d, want at least %d", st.TxPackets, len(want))
+	}
+}
+
+func TestSendBatchEqual(t *testing.T) {
+	testSendBatch(t, 1000)
+}
+
+func TestSendBatchMixed(t *testing.T) {
+	testSendBatch(t, 1000, 1000, 1000, 300, 1200, 64, MaxMessageSize)
+}
+
+func TestSendBatchTooLarge(t *testing.T) {
+	_, cli := newPair(t, nil, nil)
+	if n, err := cli.SendBatchTo([][]byte{make([]byte, MaxMessageSize+1)}, 0); n != 0 || !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("SendBatchTo = %d, %v, want %v", n, err, ErrMessageTooLarge)
+	}
+}
@@ -0,0 +1,55 @@
+package sudp
+
+import "testing"
+
+// benchmarkSend sends a message from the client and receives it in the server
+// with recv, one at a time so none is lost.
+func benchmarkSend(b *testing.B, recv func(srv *ServerConn, in []byte) error) {
+	srv, cli := newPair(b, nil, nil)
+	out := make([]byte, 1000)
+	in := make([]byte, pktbuffSize)
+	b.SetBytes(int64(len(out)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if err := cli.Send(out); err != nil {
+			b.Fatal(err)
+		}
+		if err := recv(srv, in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendRecvInto(b *testing.B) {
+	benchmarkSend(b, func(srv *ServerConn, in []byte) error {
+		_, _, err := srv.RecvInto(in)
+		return err
+	})
+}
+
+func BenchmarkSendRecvFrom(b *testing.B) {
+	benchmarkSend(b, func(srv *ServerConn, _ []byte) error {
+		_, _, err := srv.RecvFrom()
+		return err
+	})
+}
+
+func BenchmarkSendBatchTo(b *testing.B) {
+	srv, cli := newPair(b, nil, nil)
+	buffs := batch(0, 8, 1000)
+	in := make([]byte, pktbuffSize)
+	b.SetBytes(int64(len(buffs) * len(buffs[0])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := cli.SendBatchTo(buffs, 0); err != nil {
+			b.Fatal(err)
+		}
+		for range buffs {
+			if _, _, err := srv.RecvInto(in); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
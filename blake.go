@@ -19,12 +19,47 @@
 
 package sudp
 
-import "golang.org/x/crypto/blake2b"
+import (
+	"bytes"
+	"hash"
+	"sync"
 
-func blake192Hmac(b []byte, key []byte) [24]byte {
-	var sum [24]byte
-	h, _ := blake2b.New(24, key)
-	h.Write(b)
-	copy(sum[:], h.Sum(nil))
+	"golang.org/x/crypto/blake2b"
+)
+
+// blakeHash is a pooled keyed hash with the space for its sum.
+type blakeHash struct {
+	h   hash.Hash
+	sum [24]byte
+}
+
+// hmacKey is a shared hmac key with a pool of its hashes, since keyed hashes
+// can not change their key. It is replaced, never modified, when the key of a
+// peer changes, so the pool goes away with the peer or its old key.
+type hmacKey struct {
+	key  []byte
+	pool sync.Pool
+}
+
+func newHmacKey(key []byte) *hmacKey {
+	k := &hmacKey{key: bytes.Clone(key)}
+	k.pool.New = func() any {
+		h, _ := blake2b.New(24, k.key)
+		return &blakeHash{h: h}
+	}
+	return k
+}
+
+// equal reports whether k holds key.
+func (k *hmacKey) equal(key []byte) bool {
+	return bytes.Equal(k.key, key)
+}
+
+func blake192Hmac(b []byte, key *hmacKey) [24]byte {
+	bh := key.pool.Get().(*blakeHash)
+	bh.h.Reset()
+	bh.h.Write(b)
+	sum := [24]byte(bh.h.Sum(bh.sum[:0]))
+	key.pool.Put(bh)
 	return sum
 }
@@ -0,0 +1,150 @@
+package sudp
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	DefaultPort  = 0 // Port used by Send, SendTo, Recv and RecvFrom
+	channelQueue = 64
+)
+
+// Channel is a logical flow within the sessions of a connection. Messages are
+// tagged with the channel port inside the encrypted payload and every channel
+// has its own receive queue, so a slow consumer does not block the others.
+type Channel struct {
+	port   uint16
+	remote *uint16 // Default destination, nil for server channels
+	conn   *Conn
+	queue  chan *message
+	ports  *portMap
+}
+
+type portMap struct {
+	lock   sync.RWMutex
+	chans  map[uint16]*Channel
+	closed bool
+}
+
+func (m *portMap) bind(c *Conn, port uint16, remote *uint16) (*Channel, error) {
+	if port == DefaultPort {
+		return nil, fmt.Errorf("port %d is reserved", port)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if m.chans == nil {
+		m.chans = make(map[uint16]*Channel)
+	}
+	if _, ok := m.chans[port]; ok {
+		return nil, fmt.Errorf("port %d already in use", port)
+	}
+	ch := &Channel{
+		port:   port,
+		remote: remote,
+		conn:   c,
+		queue:  make(chan *message, channelQueue),
+		ports:  m,
+	}
+	m.chans[port] = ch
+	return ch, nil
+}
+
+func (m *portMap) unbind(ch *Channel) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.chans[ch.port] != ch {
+		return false
+	}
+	delete(m.chans, ch.port)
+	ch.drain()
+	return true
+}
+
+// deliver never blocks the connection loop, messages for a full or unknown
+// channel are dropped whatever the QueuePolicy of the connection.
+func (m *portMap) deliver(msg *message) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ch, ok := m.chans[msg.port]
+	if !ok {
+		return fmt.Errorf("port not bound")
+	}
+	select {
+	case ch.queue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("port queue full")
+	}
+}
+
+func (m *portMap) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	for port, ch := range m.chans {
+		delete(m.chans, port)
+		ch.drain()
+	}
+}
+
+// drain closes the queue of an unbound channel and releases the messages left,
+// a blocked RecvFrom returns ErrClosed.
+func (ch *Channel) drain() {
+	close(ch.queue)
+	for msg := range ch.queue {
+		msg.release()
+	}
+}
+
+func (ch *Channel) Port() uint16 {
+	return ch.port
+}
+
+// Send sends a message to the default remote of the channel. Only channels
+// created with ClientConn.Open have one.
+func (ch *Channel) Send(buff []byte) error {
+	if ch.remote == nil {
+		return fmt.Errorf("channel without remote, use SendTo")
+	}
+	return ch.SendTo(buff, *ch.remote)
+}
+
+func (ch *Channel) SendTo(buff []byte, addr uint16) error {
+	if !ch.conn.open.isOpen() {
+		return ErrClosed
+	}
+	return ch.conn.sendMessage(message{
+		kind: typeData,
+		port: ch.port,
+		buff: buff,
+		addr: addr,
+	})
+}
+
+func (ch *Channel) Recv() ([]byte, error) {
+	buff, _, err := ch.RecvFrom()
+	return buff, err
+}
+
+func (ch *Channel) RecvFrom() ([]byte, uint16, error) {
+	return recvCopy(<-ch.queue)
+}
+
+// RecvInto copies the next message into b and returns its size and source,
+// without allocating. If b is too small the message is truncated and
+// io.ErrShortBuffer is returned.
+func (ch *Channel) RecvInto(b []byte) (int, uint16, error) {
+	return recvInto(<-ch.queue, b)
+}
+
+// Close unbinds the port. Pending messages are discarded.
+func (ch *Channel) Close() error {
+	if !ch.ports.unbind(ch) {
+		return ErrClosed
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package sudp
+
+import "testing"
+
+// Messages reach the channel bound to their port, and the default port
+// reaches RecvFrom, in both directions.
+func TestChannelRouting(t *testing.T) {
+	srv, cli := newPair(t, nil, nil)
+	sch, err := srv.Listen(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cch, err := cli.Open(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Listen(7); err == nil {
+		t.Fatal("port bound twice")
+	}
+	if _, err := srv.Listen(DefaultPort); err == nil {
+		t.Fatal("default port bound")
+	}
+
+	if err := cch.Send([]byte("port 7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Send([]byte("port 0")); err != nil {
+		t.Fatal(err)
+	}
+	if b, from, err := sch.RecvFrom(); err != nil || string(b) != "port 7" || from != 1 {
+		t.Fatalf("channel RecvFrom = %q, %d, %v", b, from, err)
+	}
+	if b := recvAll(t, srv, 1); string(b[0]) != "port 0" {
+		t.Fatalf("RecvFrom = %q", b[0])
+	}
+
+	if err := sch.SendTo([]byte("reply 7"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SendTo([]byte("reply 0"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := cch.Recv(); err != nil || string(b) != "reply 7" {
+		t.Fatalf("channel Recv = %q, %v", b, err)
+	}
+	if b, from, err := cli.RecvFrom(); err != nil || string(b) != "reply 0" || from != 0 {
+		t.Fatalf("RecvFrom = %q, %d, %v", b, from, err)
+	}
+
+	// Messages to a closed channel are dropped, not delivered to RecvFrom
+	if err := sch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sch.Close(); err == nil {
+		t.Fatal("channel closed twice")
+	}
+	if err := cch.Send([]byte("unbound")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the unbound message to be dropped", func() bool {
+		st, _ := srv.Stats()
+		return st.RecvDrops == 1
+	})
+}
+
+// A full channel drops the next messages without blocking the other ports.
+func TestChannelQueueFull(t *testing.T) {
+	srv, cli := newPair(t, nil, nil)
+	sch, err := srv.Listen(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cch, err := cli.Open(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const extra = 5
+	for range channelQueue + extra {
+		if err := cch.Send([]byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cli.Send([]byte("default port")); err != nil {
+		t.Fatal(err)
+	}
+	if b := recvAll(t, srv, 1); string(b[0]) != "default port" {
+		t.Fatalf("RecvFrom = %q", b[0])
+	}
+	waitFor(t, "the overflow to be dropped", func() bool {
+		st, _ := srv.Stats()
+		return st.RecvDrops == extra
+	})
+	for range channelQueue {
+		if b, err := sch.Recv(); err != nil || string(b) != "queued" {
+			t.Fatalf("channel Recv = %q, %v", b, err)
+		}
+	}
+	if n := len(sch.queue); n != 0 {
+		t.Fatalf("%d messages left in the channel", n)
+	}
+}
+
+// Unbinding a channel, or closing all of them, releases the queued packets.
+func TestChannelDrain(t *testing.T) {
+	var m portMap
+	queued := func(ch *Channel) []*message {
+		var msgs []*message
+		for range 3 {
+			msg := &message{port: ch.port, pkt: allocPktbuff()}
+			if err := m.deliver(msg); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+	a, err := m.bind(&Conn{}, 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.bind(&Conn{}, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := queued(a)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.RecvFrom(); err != ErrClosed {
+		t.Fatalf("RecvFrom of a closed channel = %v", err)
+	}
+	msgs = append(msgs, queued(b)...)
+	m.close()
+	for i, msg := range msgs {
+		if msg.pkt != nil {
+			t.Fatalf("message %d not released", i)
+		}
+	}
+}
@@ -2,47 +2,110 @@ package sudp
 
 import (
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 type ClientConn struct {
-	server *peer
-	opts   *ClientOpts
+	server    *peer
+	opts      *ClientOpts
+	timers    timers
+	endpoints []*net.UDPAddr   // Server endpoints in order of preference
+	active    int              // Endpoint in use
+	failed    int              // Endpoints failed in a row
+	direct    map[uint16]*peer // Peers reachable without the server relay
+	punches   map[uint16]*punchstate
+	state     atomic.Int32
+	attempts  int         // Reconnection attempts
+	retryAt   time.Time   // Next reconnection
+	queue     []*message  // Messages sent while down
+	kicked    *CloseError // Session closed by the server
 	Conn
 }
 
 type ClientOpts struct {
-	Tries       int
-	TimeRetry   int
-	EpochChange int
+	Tries             int              // Handshake attempts per endpoint, default 4
+	TimeRetry         int              // Deprecated: use HandshakeRetry
+	EpochChange       int              // Deprecated: use EpochLifetime
+	KeepAliveInterval time.Duration    // Default 500ms
+	IdleTimeout       time.Duration    // Server silence before failover, default 5s
+	HandshakeRetry    time.Duration    // Default 2s
+	EpochLifetime     time.Duration    // Default 30s
+	PrevEpochGrace    time.Duration    // Previous epoch accepted after a rotation, 0 until the next one
+	Reconnect         *ReconnectPolicy // Optional, the connection is closed when the server is unreachable
+	OnStateChange     func(ConnState)  // Called from the connection loop, it must not block
+	Logger            *slog.Logger     // Optional, nothing is logged without it
+	RecvQueue         *QueuePolicy     // Optional, 10 messages blocking the loop when full
 }
 
-func (c *ClientConn) filterPacket(pkt *pktbuff) (*hdr, error) {
-	hdr, e := hdrLoad(pkt.head(hdrsz), c.server.hmackey)
-	if e != nil || hdr.dst != c.vaddr {
-		return nil, newError("invalid header - message drop", e)
+func (c *ClientConn) filterPacket(pkt *pktbuff) (*peer, *hdr, error) {
+	if !sameAddr(pkt.addr, c.server.naddr) {
+		return c.filterDirect(pkt)
 	}
-	if c.server == nil && c.server.vaddr != hdr.src || c.vaddr != hdr.dst {
-		return nil, newError("invalid source - message drop", nil)
+	hdr, e := pkt.loadHdr(pkt.head(hdrsz), c.server.hmackey)
+	if e != nil {
+		return c.server, nil, newDrop(DropMalformed, "invalid header - message drop", e)
 	}
-
-	if c.server.tsync == nil {
-		if c.server.tsync, e = newTimeSync(hdr.time); e != nil {
-			return nil, newError("not in time - message drop", e)
-		}
-	} else if !c.server.tsync.inTime(hdr.time) {
-		return nil, newError("not in time - message drop", e)
+	if hdr.dst != c.vaddr {
+		return c.server, nil, newDrop(DropUnknownSource, "invalid destination - message drop", nil)
+	}
+	// Only data can be relayed by the server from other peers
+	if c.server.vaddr != hdr.src && hdr.kind != typeData && hdr.kind != typeStream {
+		return c.server, nil, newDrop(DropUnknownSource, "invalid source - message drop", nil)
 	}
-	return hdr, nil
+	if e := c.server.inTime(hdr); e != nil {
+		return c.server, nil, e
+	}
+	return c.server, hdr, nil
 }
 
+// RemoteAddress returns the server endpoint in use.
 func (c *ClientConn) RemoteAddress() string {
-	if c != nil {
-		return c.server.naddr.String()
+	if c == nil {
+		return ""
+	}
+	var addr string
+	get := func() { addr = c.server.naddr.String() }
+	if c.call(get) != nil {
+		get()
+	}
+	return addr
+}
+
+// shutdown ends the connection loop after a failure, e is kept for GetErrors.
+func (c *ClientConn) shutdown(e error) {
+	c.open.setStat(statClose)
+	c.setState(StateClosed)
+	c.release()
+	c.conn.Close()
+	for p := <-c.ch.netRx; p != nil; p = <-c.ch.netRx {
+	}
+	c.ch.close()
+	c.err <- e
+	close(c.err)
+}
+
+// failover moves the session to the next server endpoint and restarts the
+// handshake. With a single endpoint the handshake is retried with the same one.
+func (c *ClientConn) failover() {
+	c.active = (c.active + 1) % len(c.endpoints)
+	c.server.wipe()
+	c.server.naddr = c.endpoints[c.active]
+	c.server.rtt = rttStats{}
+	c.server.handshake = nil
+	c.server.ready = false
+	c.server.tsync = nil
+	c.server.ttlm = time.Time{}
+	c.server.publish()
+	c.resetStreams(allStreams)
+	c.log.info("using server endpoint", "vaddr", c.server.vaddr, "addr", c.server.naddr)
+	// A handshake that could not be written is retried like a lost one
+	if e := c.server.initiate(&c.Conn, rand.Intn(65536)); e != nil {
+		c.log.warn("failover handshake", append(peerAttrs(c.server), "err", e)...)
 	}
-	return ""
 }
 
 func (c *ClientConn) serve() error {
@@ -56,17 +119,25 @@ func (c *ClientConn) serve() error {
 
 		start = true
 		//		tries = 0
-		control := time.NewTicker(500 * time.Millisecond)
+		control := time.NewTicker(c.timers.keepAlive)
 		for {
 			select {
 			case <-c.ch.exit:
 				goto exit
 			case msg := <-c.ch.userTx:
-				if c.server == nil || c.server.vaddr != msg.addr || !c.server.ready {
-					c.ch.errUTx <- newError("not ready", nil)
+				if p, ok := c.direct[msg.addr]; ok && p.ready && p.epochs.cEpoch != -1 {
+					c.ch.errUTx <- p.sendDataPacket(c.vaddr, msg, c.conn)
 					continue
 				}
-				e := c.server.sendDataPacket(c.vaddr, msg.buff, c.conn)
+				if c.server == nil || !c.server.ready {
+					if c.enqueue(msg) {
+						c.ch.errUTx <- nil
+						continue
+					}
+					c.ch.errUTx <- ErrNotReady
+					continue
+				}
+				e := c.server.sendDataPacket(c.vaddr, msg, c.conn)
 				if e != nil {
 					c.ch.errUTx <- newError("sending data packet:", e)
 					continue
@@ -75,67 +146,84 @@ func (c *ClientConn) serve() error {
 			case pkt := <-c.ch.netRx:
 				if pkt == nil {
 					c.open.setStat(statClose)
-					c.err <- fmt.Errorf("unexpected close")
+					c.err <- ErrUnexpectedClose
 					close(c.err)
 					return
 				}
-				hdr, e := c.filterPacket(pkt)
+				peer, hdr, e := c.filterPacket(pkt)
 				if e != nil {
-					log(Warn, fmt.Sprintf("filter: %v", e))
+					c.dropped(peer, e)
+					c.logDrop(peer, pkt.addr, e)
+					pkt.release()
 					continue
 				}
-				e = c.server.handlePacket(hdr, pkt, c.private, c.ch.userRx, c.conn)
+				// The packet is released by handlePacket
+				addr := pkt.addr
+				e = peer.handlePacket(hdr, pkt, &c.Conn)
 				if e != nil {
-					log(Warn, fmt.Sprintf("at package handle - %v", e))
+					c.dropped(peer, e)
+					c.logDrop(peer, addr, e)
+				}
+				if e := c.kicked; e != nil {
+					c.kicked = nil
+					if c.opts.Reconnect != nil && !start && c.opts.Reconnect.retries(e.Reason) && c.down() {
+						continue
+					}
+					c.shutdown(e)
+					return
 				}
+			case f := <-c.ch.calls:
+				f()
 
 			case e := <-c.ch.errNRx:
 				c.open.setStat(statClose)
-				c.err <- fmt.Errorf("at reception %v -> panic", e)
+				c.err <- fmt.Errorf("at reception %w -> panic", e)
 				close(c.err)
 				return
 			case <-control.C:
+				if c.server.ready && time.Since(c.server.ttlm) > c.timers.idle {
+					c.log.info("server idle", append(peerAttrs(c.server), "idle", c.timers.idle)...)
+					c.failover()
+				}
 				if c.server.ready {
-					var ctrl ctrlmessage
 					epoch, _ := c.server.epochs.current()
-					header := newHdr(typeCtrlMessage, uint32(epoch), c.vaddr, c.server.vaddr)
-					header.len = ctrlmessagesz
-					packet := allocPktbuff()
-					packet.addr = c.server.naddr
-					if err := header.dump(packet.tail(hdrsz), c.server.hmackey); err != nil {
-						continue
+					c.server.probe(&c.Conn, uint32(epoch), KeepAlive)
+					if c.server.handshake == nil {
+						c.failed = 0
 					}
-					ctrl.hmac = header.hmac
-					ctrl.set(KeepAlive)
-					if err := ctrl.dump(packet.tail(ctrlmessagesz), c.private); err != nil {
-						continue
-					}
-					packet.pktSend(c.conn)
 				}
-				if c.server.handshake != nil && c.server.handshake.timeRetry(c.opts.TimeRetry) {
-					if c.server.handshake.tries == c.opts.Tries {
-						c.open.setStat(statClose)
-						c.conn.Close()
-						e := <-c.ch.netRx
-						for ; e != nil; e = <-c.ch.netRx {
+				c.server.epochs.expire(c.timers.grace)
+				c.keepDirect()
+				if c.State() == StateDown && time.Now().After(c.retryAt) {
+					c.reconnect()
+				}
+				if c.server.handshake != nil && c.server.handshake.timeRetry(c.timers.handshakeRetry(c.server)) {
+					if c.server.handshake.tries >= c.opts.Tries {
+						c.server.stats.hsFail++
+						if c.failed++; c.failed < len(c.endpoints) {
+							c.failover()
+							continue
 						}
-
-						c.ch.close()
-						c.err <- fmt.Errorf("timeout")
-						close(c.err)
+						if c.opts.Reconnect != nil && !start && c.down() {
+							continue
+						}
+						c.shutdown(&HandshakeError{VirtualAddress: c.server.vaddr, NetworkAddress: c.server.naddr, Err: ErrHandshakeTimeout})
 						return
 					}
 					//	c.server.hsSent = time.Now()
 					rsnd, err := c.server.handshake.repack(c.private, c.server.hmackey)
 					if err == nil {
 						rsnd.addr = c.server.naddr
-						rsnd.pktSend(c.conn)
+						c.server.send(rsnd, c.conn)
 					}
 
 				}
 			case <-refresh:
 				var epoch int
 				//tries = 0
+				if c.State() == StateDown {
+					continue
+				}
 				if pending, _ := c.server.epochs.pending(); pending != -1 {
 					continue // Evaluar que hacemos aca
 				}
@@ -144,59 +232,42 @@ func (c *ClientConn) serve() error {
 				} else {
 					epoch = c.server.epochs.cEpoch + 1
 				}
-				key, err := c.server.epochs.new(epoch)
-				if err != nil {
-					continue
-				}
-				header := newHdr(typeClientHandshake, uint32(epoch), c.vaddr, c.server.vaddr)
-				header.len = handshakesz
-				packet := allocPktbuff()
-				packet.addr = c.server.naddr
-				if err = header.dump(packet.tail(hdrsz), c.server.hmackey); err != nil {
-					continue
-				}
-				handshake := handshake{
-					hmac: header.hmac,
-				}
-				copy(handshake.pubkey[:], key.public())
-				if err = handshake.dump(packet.tail(handshakesz), c.private); err != nil {
-					continue
-				}
-				//c.server.hndshk = true
-				//c.server.hsSent = time.Now()
-				//c.server.resend = &pkthandshakeraw{
-				//	hdr: *header,
-				//	hsk: handshake,
-				//}
-				c.server.handshake = &handshakestate{
-					tries:    0,
-					senttime: time.Now(),
-					hdr:      *header,
-					msg:      handshake,
-				}
-				packet.pktSend(c.conn)
+				c.server.initiate(&c.Conn, epoch)
 			}
 			if start && c.server.ready {
 				start = false
 				//tries = 0
-				refresh = time.NewTicker(time.Duration(c.opts.EpochChange) * time.Second).C
+				refresh = time.NewTicker(c.timers.lifetime).C
 				c.err <- nil
 			}
+			if c.server.ready {
+				c.setState(StateUp)
+			} else if c.State() == StateUp {
+				c.setState(StateConnecting)
+			}
 		}
 	exit:
+		c.server.notify(&c.Conn, CloseNormal)
+		for _, d := range c.direct {
+			d.notify(&c.Conn, CloseNormal)
+		}
 		c.open.setStat(statClose)
+		c.setState(StateClosed)
+		c.release()
 		c.conn.Close()
 		for {
 			select {
 			case _, ok := <-c.ch.netRx:
 				if !ok {
 					c.err <- nil
+					close(c.err)
 					c.ch.close()
 					return
 				}
 			case e, ok := <-c.ch.errNRx:
 				if ok {
 					c.err <- e
+					close(c.err)
 					c.ch.close()
 					return
 				}
@@ -207,43 +278,70 @@ func (c *ClientConn) serve() error {
 	return <-c.err
 }
 
+// Connect establishes a session with the server. Besides raddr.NetworkAddress
+// the server may be reached through raddr.Endpoints, which are tried in order
+// when the handshake fails or the server stops answering the keepalives.
+// Connect fails if the first session can not be established, even with a
+// reconnect policy in opts.
 func Connect(laddr *LocalAddr, raddr *RemoteAddr, opts *ClientOpts) (*ClientConn, error) {
 
-	if raddr.NetworkAddress == nil {
+	endpoints := raddr.endpoints()
+	if len(endpoints) == 0 {
 		return nil, fmt.Errorf("invalid peer address")
 	}
 	if laddr.PrivateKey == nil || raddr.PublicKey == nil {
 		return nil, fmt.Errorf("keys not present")
 	}
 
-	conn, err := net.ListenUDP("udp4", laddr.NetworkAddress)
+	if opts == nil {
+		opts = &ClientOpts{}
+	}
+	timers, err := newTimers(opts.KeepAliveInterval, opts.IdleTimeout, opts.HandshakeRetry,
+		opts.EpochLifetime, opts.PrevEpochGrace, opts.TimeRetry, opts.EpochChange)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tries <= 0 {
+		o := *opts
+		o.Tries = defaultTries
+		opts = &o
+	}
+	queue, err := queuePolicy(opts.RecvQueue)
 	if err != nil {
 		return nil, err
 	}
 
-	if opts == nil {
-		opts = &ClientOpts{
-			TimeRetry:   2,
-			Tries:       4,
-			EpochChange: 30,
-		}
+	conn, err := net.ListenUDP("udp4", laddr.NetworkAddress)
+	if err != nil {
+		return nil, err
 	}
+
 	c := &ClientConn{
-		opts: opts,
+		opts:      opts,
+		timers:    timers,
+		endpoints: endpoints,
 		Conn: Conn{
 			vaddr:   laddr.VirtualAddress,
 			conn:    conn,
+			writer:  newPktWriter(conn),
 			private: laddr.PrivateKey,
 			err:     make(chan error),
+			log:     logger{l: opts.Logger},
+			queue:   queue,
 		},
 		server: &peer{
 			vaddr:   raddr.VirtualAddress,
-			naddr:   raddr.NetworkAddress,
-			hmackey: []byte(raddr.SharedHmacKey),
+			naddr:   endpoints[0],
+			hmackey: newHmacKey(raddr.SharedHmacKey),
 			pubkey:  raddr.PublicKey,
 		},
 	}
-	c.ch.init(c.conn, c.server.naddr)
+	c.via = c.server
+	c.onData = c.deliver
+	c.onCtrl = c.control
+	c.direct = make(map[uint16]*peer)
+	c.punches = make(map[uint16]*punchstate)
+	c.ch.init(c.conn, nil, queue.Size)
 	c.server.epochs.init()
 
 	if e := c.serve(); e != nil {
@@ -256,7 +354,14 @@ func Connect(laddr *LocalAddr, raddr *RemoteAddr, opts *ClientOpts) (*ClientConn
 func (s *ClientConn) GetErrors() error {
 	var err error
 	for e := range s.err {
-		err = fmt.Errorf("%v, %v", err, e)
+		if e == nil {
+			continue
+		}
+		if err == nil {
+			err = e
+		} else {
+			err = fmt.Errorf("%w, %w", err, e)
+		}
 	}
 	return err
 }
@@ -266,6 +371,7 @@ func (s *ClientConn) Close() error {
 		return fmt.Errorf("invalid connection")
 	}
 	if s.open.isOpen() {
+		s.ch.stop()
 		s.ch.exit <- true
 	}
 
@@ -274,22 +380,91 @@ func (s *ClientConn) Close() error {
 
 func (s *ClientConn) Send(buff []byte) error {
 	if s == nil || !s.open.isOpen() {
-		return fmt.Errorf("connection closed")
+		return ErrClosed
 	}
-	s.ch.userTx <- &message{
+	return s.sendMessage(message{
+		kind: typeData,
 		buff: buff,
 		addr: s.server.vaddr,
+	})
+}
+
+// SendTo sends a message to another peer of the server, which relays it when
+// relaying is enabled.
+func (s *ClientConn) SendTo(buff []byte, addr uint16) error {
+	if s == nil || !s.open.isOpen() {
+		return ErrClosed
+	}
+	return s.sendMessage(message{
+		kind: typeData,
+		buff: buff,
+		addr: addr,
+	})
+}
+
+// SendBatchTo sends the messages of buffs to addr in order, like SendTo, and
+// returns how many were sent. Equal sized messages are written together with
+// UDP segmentation offload where the platform supports it.
+func (s *ClientConn) SendBatchTo(buffs [][]byte, addr uint16) (int, error) {
+	if s == nil || !s.open.isOpen() {
+		return 0, ErrClosed
 	}
-	return <-s.ch.errUTx
+	return s.sendMessages(buffs, addr)
 }
 
 func (s *ClientConn) Recv() ([]byte, error) {
+	buff, _, err := s.RecvFrom()
+	return buff, err
+}
+
+// RecvFrom returns the next message and the virtual address of its source,
+// either the server or a peer relayed by it.
+func (s *ClientConn) RecvFrom() ([]byte, uint16, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, 0, ErrClosed
+	}
+	return recvCopy(<-s.ch.userRx)
+}
+
+// RecvInto copies the next message into b and returns its size and source,
+// without allocating. If b is too small the message is truncated and
+// io.ErrShortBuffer is returned.
+func (s *ClientConn) RecvInto(b []byte) (int, uint16, error) {
 	if s == nil || !s.open.isOpen() {
-		return nil, fmt.Errorf("connection closed")
+		return 0, 0, ErrClosed
 	}
-	msg := <-s.ch.userRx
-	if msg == nil {
-		return nil, fmt.Errorf("connection closed")
+	return recvInto(<-s.ch.userRx, b)
+}
+
+// OpenStream opens a reliable stream to the server.
+func (s *ClientConn) OpenStream() (*Stream, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return s.streams().open(s.server.vaddr)
+}
+
+// OpenStreamTo opens a reliable stream to another peer relayed by the server.
+func (s *ClientConn) OpenStreamTo(addr uint16) (*Stream, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return s.streams().open(addr)
+}
+
+// AcceptStream waits for a stream opened by the server or a relayed peer.
+func (s *ClientConn) AcceptStream() (*Stream, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return s.streams().acceptStream()
+}
+
+// Open binds a logical channel identified by port. Messages sent through the
+// returned channel are delivered to the channel with the same port at the server.
+func (s *ClientConn) Open(port uint16) (*Channel, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
 	}
-	return msg.buff, nil
+	return s.ports.bind(&s.Conn, port, &s.server.vaddr)
 }
@@ -0,0 +1,88 @@
+package sudp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// The loss of the socket ends the connection with ErrUnexpectedClose.
+func TestClientUnexpectedClose(t *testing.T) {
+	_, cli := newPair(t, nil, nil)
+	cli.conn.Close()
+	if err := cli.GetErrors(); !errors.Is(err, ErrUnexpectedClose) {
+		t.Fatalf("GetErrors = %v, want %v", err, ErrUnexpectedClose)
+	}
+	if err := cli.Send([]byte("closed")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Send = %v, want %v", err, ErrClosed)
+	}
+}
+
+// A session closed by the server ends the connection with its reason.
+func TestClientKicked(t *testing.T) {
+	srv, cli := newPair(t, nil, nil)
+	if err := cli.Send([]byte("ready")); err != nil {
+		t.Fatal(err)
+	}
+	recvAll(t, srv, 1)
+	if err := srv.Kick(1, CloseKicked); err != nil {
+		t.Fatal(err)
+	}
+	err := cli.GetErrors()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Reason != CloseKicked || !errors.Is(err, ErrClosed) {
+		t.Fatalf("GetErrors = %v, want a %v close", err, CloseKicked)
+	}
+}
+
+// A client moves to the next server endpoint when the first one stops, before
+// or after the session is up.
+func TestClientFailover(t *testing.T) {
+	for _, before := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stopped before connect=%v", before), func(t *testing.T) {
+			skey, _ := GenerateKey()
+			ckey, _ := GenerateKey()
+			hmkey := []byte("test hmac key")
+			var srvs [2]*ServerConn
+			for i := range srvs {
+				srv, err := Listen(&LocalAddr{PrivateKey: skey, NetworkAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+					[]*RemoteAddr{{VirtualAddress: 1, PublicKey: &ckey.PublicKey, SharedHmacKey: hmkey}}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(srv.Close)
+				srvs[i] = srv
+			}
+			first := srvs[0].conns[0].LocalAddr().(*net.UDPAddr)
+			second := srvs[1].conns[0].LocalAddr().(*net.UDPAddr)
+			if before {
+				srvs[0].Close()
+			}
+			cli, err := Connect(&LocalAddr{VirtualAddress: 1, PrivateKey: ckey},
+				&RemoteAddr{PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: first,
+					Endpoints: []Endpoint{{NetworkAddress: second}}},
+				&ClientOpts{Tries: 2, KeepAliveInterval: 20 * time.Millisecond, HandshakeRetry: 50 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+			if !before {
+				if got := cli.RemoteAddress(); got != first.String() {
+					t.Fatalf("RemoteAddress = %s, want %s", got, first)
+				}
+				srvs[0].Close()
+			}
+			waitFor(t, "the failover", func() bool {
+				return cli.RemoteAddress() == second.String() && cli.State() == StateUp
+			})
+			if err := cli.Send([]byte("failed over")); err != nil {
+				t.Fatal(err)
+			}
+			if b := recvAll(t, srvs[1], 1); string(b[0]) != "failed over" {
+				t.Fatalf("RecvFrom = %q", b[0])
+			}
+		})
+	}
+}
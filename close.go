@@ -0,0 +1,122 @@
+package sudp
+
+import (
+	"fmt"
+	"net"
+)
+
+// CloseReason is the code carried by the Close control flag. Applications may
+// kick peers with their own codes.
+type CloseReason uint32
+
+const (
+	CloseNormal  CloseReason = iota // Connection closed by the application
+	CloseRemoved                    // Peer removed from the server
+	CloseRekeyed                    // Keys of the peer replaced
+	CloseKicked                     // Session closed by the server
+	CloseTimeout                    // No activity from the peer, never sent
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseNormal:
+		return "closed"
+	case CloseRemoved:
+		return "removed"
+	case CloseRekeyed:
+		return "keys updated"
+	case CloseKicked:
+		return "kicked"
+	case CloseTimeout:
+		return "idle timeout"
+	}
+	return fmt.Sprintf("CloseReason(%d)", uint32(r))
+}
+
+// notify sends the Close control flag to p, if there is a session to close.
+// The pending epoch is used while the first EpochAck is on its way.
+func (p *peer) notify(conn *Conn, reason CloseReason) {
+	epoch, _ := p.epochs.current()
+	if epoch == -1 {
+		epoch, _ = p.epochs.pending()
+	}
+	if !p.ready || epoch == -1 || p.naddr == nil {
+		return
+	}
+	if e := p.sendCtrl(conn, uint32(epoch), Close, uint64(reason)); e != nil {
+		conn.log.warn("sending close", append(peerAttrs(p), "reason", reason, "err", e)...)
+	}
+}
+
+func (s *ServerConn) emitDown(p *peer, naddr *net.UDPAddr, reason CloseReason, remote bool) {
+	if s.opts.Events == nil {
+		return
+	}
+	e := Event{
+		Kind:           PeerDown,
+		VirtualAddress: p.vaddr,
+		NetworkAddress: naddr,
+		Epoch:          -1,
+		Reason:         reason.String(),
+		Code:           reason,
+	}
+	if remote {
+		e.Reason = "closed by peer: " + e.Reason
+	}
+	s.opts.Events(e)
+}
+
+// Kick closes the session of a connected peer, notifying it with reason. The
+// peer may connect again.
+func (s *ServerConn) Kick(vaddr uint16, reason CloseReason) error {
+	if s == nil || !s.open.isOpen() {
+		return ErrClosed
+	}
+	var e error
+	if err := s.callPeer(vaddr, func(w *worker) {
+		p, ok := w.peerMap[vaddr]
+		if !ok {
+			e = fmt.Errorf("%w %d", ErrUnknownPeer, vaddr)
+			return
+		}
+		if !p.ready {
+			e = fmt.Errorf("peer %d: %w", vaddr, ErrNotReady)
+			return
+		}
+		s.drop(p, reason)
+	}); err != nil {
+		return err
+	}
+	return e
+}
+
+// closed tears down the session of a peer that sent the Close control flag.
+func (s *ServerConn) closed(p *peer, reason CloseReason) {
+	naddr := p.naddr
+	s.log.info("session closed by peer", append(peerAttrs(p), "reason", reason)...)
+	s.reset(p)
+	s.emitDown(p, naddr, reason, true)
+}
+
+// closed handles the Close control flag from the server or a direct peer. The
+// loop ends the connection once the packet is handled, unless it reconnects.
+func (c *ClientConn) closed(p *peer, reason CloseReason) {
+	if p != c.server {
+		c.log.info("direct session closed by peer - using relay", append(peerAttrs(p), "reason", reason)...)
+		c.resetDirect(p)
+		return
+	}
+	c.log.info("session closed by the server", append(peerAttrs(p), "reason", reason)...)
+	if reason == CloseNormal && len(c.endpoints) > 1 {
+		// The server is shutting down, another endpoint may be up
+		c.failed++
+		c.failover()
+		return
+	}
+	c.server.wipe()
+	c.server.handshake = nil
+	c.server.ready = false
+	c.server.publish()
+	c.resetStreams(allStreams)
+	c.kicked = &CloseError{Reason: reason}
+}
@@ -0,0 +1,59 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A Close captured from a previous session does not end the next one.
+func TestCloseReplay(t *testing.T) {
+	skey, _ := GenerateKey()
+	ckey, _ := GenerateKey()
+	hmkey := []byte("test hmac key")
+	srv, err := Listen(&LocalAddr{PrivateKey: skey, NetworkAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		[]*RemoteAddr{{VirtualAddress: 1, PublicKey: &ckey.PublicKey, SharedHmacKey: hmkey}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	proxy := newLossyProxy(t, srv.conns[0].LocalAddr().(*net.UDPAddr), 0, 0)
+	connect := func() *ClientConn {
+		c, err := Connect(&LocalAddr{VirtualAddress: 1, PrivateKey: ckey},
+			&RemoteAddr{PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: proxy.addr()}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Send([]byte("up")); err != nil {
+			t.Fatal(err)
+		}
+		recvAll(t, srv, 1)
+		return c
+	}
+	ready := func() bool {
+		info, _, _ := srv.Peer(1)
+		return info.Ready
+	}
+
+	// The last control packet of a closing client is its Close
+	connect().Close()
+	waitFor(t, "the first session to close", func() bool { return !ready() })
+	closing := proxy.lastCtrl()
+
+	cli := connect()
+	defer cli.Close()
+	proxy.replay(closing)
+	time.Sleep(100 * time.Millisecond)
+	if !ready() {
+		t.Fatal("session ended by a replayed Close")
+	}
+	if peerDrops(t, srv, 1, DropInvalidEpoch) == 0 {
+		t.Fatal("replayed Close not counted as a drop")
+	}
+	if err := cli.Send([]byte("still up")); err != nil {
+		t.Fatal(err)
+	}
+	if b := recvAll(t, srv, 1); string(b[0]) != "still up" {
+		t.Fatalf("received %q", b[0])
+	}
+}
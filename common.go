@@ -1,9 +1,13 @@
 package sudp
 
 import (
+	"bytes"
 	"crypto/ecdsa"
-	"fmt"
+	"io"
+	"maps"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type channels struct {
@@ -12,44 +16,283 @@ type channels struct {
 	userTx chan *message
 	errUTx chan error
 	errNRx chan error
+	calls  chan func()
 	exit   chan bool
+	done   chan struct{}
+	quit   chan struct{} // Closed when the connection is closing, see stop
+	qonce  sync.Once
 }
 
-func (c *channels) init(conn *net.UDPConn, addr *net.UDPAddr) {
-	c.netRx, c.errNRx = ptkRxRoutine(conn, addr)
-	c.userRx = make(chan *message, 10)
+// init creates the channels of a connection, conn is nil when the caller reads
+// its sockets itself.
+func (c *channels) init(conn *net.UDPConn, addr *net.UDPAddr, queue int) {
+	if conn != nil {
+		c.netRx, c.errNRx = ptkRxRoutine(conn, addr)
+	}
+	c.userRx = make(chan *message, queue)
 	c.userTx = make(chan *message)
 	c.errUTx = make(chan error)
+	c.calls = make(chan func())
 	c.exit = make(chan bool)
+	c.done = make(chan struct{})
+	c.quit = make(chan struct{})
+}
 
+// stop releases the loops blocked delivering to a full userRx before they are
+// told to exit, their messages are dropped from then on.
+func (c *channels) stop() {
+	c.qonce.Do(func() { close(c.quit) })
 }
 
+// close releases the user side. userTx is never closed since it may have
+// many writers, they are released by done instead.
 func (c *channels) close() {
+	c.stop()
+	close(c.done)
 	close(c.exit)
 	close(c.userRx)
-	select {
-	case _, ok := <-c.userTx:
-		if ok {
-			close(c.userTx)
-			c.errUTx <- fmt.Errorf("Connection close")
-			close(c.errUTx)
-		}
-	default:
-		close(c.userTx)
-		close(c.errUTx)
-	}
 }
 
 type Conn struct {
 	vaddr   uint16
 	conn    *net.UDPConn
+	writer  *pktWriter // Batches written to conn
 	private *ecdsa.PrivateKey
 	ch      channels
 	err     chan error
 	open    stat
+	mux     atomic.Pointer[streamMux]
+	muxOnce sync.Once
+	ports   portMap
+	onData  func(*message)                  // Data received from a peer
+	onCtrl  func(*peer, *ctrlmessage) error // Control message received from a peer
+	stats   counters                        // Drops not attributed to a peer, removed peers
+	slock   sync.Mutex                      // Guards stats, written by every worker of a server
+	log     logger
+	queue   QueuePolicy                      // Receive queue, with its defaults
+	senders atomic.Pointer[map[uint16]*peer] // Peers looked up by the senders, copied on write
+	wlock   sync.Mutex                       // Serializes the writers of senders
+	via     *peer                            // Peer relaying to the destinations without a session
 }
 
 type message struct {
+	kind uint8
+	port uint16
 	buff []byte
 	addr uint16
+	dst  uint16   // Destination of received messages, it differs from the local address when relayed
+	pkt  *pktbuff // Received packet holding buff, nil if buff is not pooled
+}
+
+// release returns the packet holding the buffer of a received message to the
+// pool, the message can not be used afterwards.
+func (m *message) release() {
+	if pkt := m.pkt; pkt != nil {
+		m.pkt = nil
+		pkt.release()
+	}
+}
+
+// detach returns a copy of a received message that owns its buffer.
+func (m *message) detach() *message {
+	d := *m
+	d.buff = bytes.Clone(m.buff)
+	d.pkt = nil
+	m.release()
+	return &d
+}
+
+// recvInto copies a received message into b and releases it. It fails with
+// io.ErrShortBuffer, after copying what fits, if b is too small.
+func recvInto(msg *message, b []byte) (int, uint16, error) {
+	if msg == nil {
+		return 0, 0, ErrClosed
+	}
+	n, addr := copy(b, msg.buff), msg.addr
+	short := n < len(msg.buff)
+	msg.release()
+	if short {
+		return n, addr, io.ErrShortBuffer
+	}
+	return n, addr, nil
+}
+
+// recvCopy returns a copy of the buffer of a received message and releases it.
+func recvCopy(msg *message) ([]byte, uint16, error) {
+	if msg == nil {
+		return nil, 0, ErrClosed
+	}
+	b, addr := bytes.Clone(msg.buff), msg.addr
+	msg.release()
+	return b, addr, nil
+}
+
+// sendMessage encrypts and writes msg on the calling goroutine when the
+// session with its destination is up. Otherwise it hands the message to the
+// connection loop and waits for the result.
+func (c *Conn) sendMessage(msg message) error {
+	if len(msg.buff) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	if p, k := c.lookup(msg.addr); k != nil {
+		if e := p.sendData(k, c.vaddr, &msg, c.conn); e != nil {
+			if !c.open.isOpen() {
+				return ErrClosed
+			}
+			return newError("sending data packet:", e)
+		}
+		return nil
+	}
+	m := msg
+	select {
+	case c.ch.userTx <- &m:
+		return <-c.ch.errUTx
+	case <-c.ch.done:
+		return ErrClosed
+	}
+}
+
+// sendMessages sends buffs to dst in order, with as few system calls as
+// possible when the session is up. It returns how many were sent.
+func (c *Conn) sendMessages(buffs [][]byte, dst uint16) (int, error) {
+	for _, b := range buffs {
+		if len(b) > MaxMessageSize {
+			return 0, ErrMessageTooLarge
+		}
+	}
+	p, k := c.lookup(dst)
+	if k == nil {
+		for i, b := range buffs {
+			if e := c.sendMessage(message{kind: typeData, buff: b, addr: dst}); e != nil {
+				return i, e
+			}
+		}
+		return len(buffs), nil
+	}
+	msgs := make([]message, len(buffs))
+	ptrs := make([]*message, len(buffs))
+	for i, b := range buffs {
+		msgs[i] = message{kind: typeData, buff: b, addr: dst}
+		ptrs[i] = &msgs[i]
+	}
+	n, e := p.sendBatch(k, c.vaddr, ptrs, c.writer)
+	if e != nil {
+		if !c.open.isOpen() {
+			return n, ErrClosed
+		}
+		return n, newError("sending data packets:", e)
+	}
+	return n, nil
+}
+
+// addSender and removeSender update the peers looked up by the senders, they
+// are called before the loop starts or from the loops.
+func (c *Conn) addSender(p *peer) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	m := make(map[uint16]*peer)
+	if old := c.senders.Load(); old != nil {
+		maps.Copy(m, *old)
+	}
+	m[p.vaddr] = p
+	c.senders.Store(&m)
+}
+
+func (c *Conn) removeSender(vaddr uint16) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	old := c.senders.Load()
+	if old == nil {
+		return
+	}
+	m := maps.Clone(*old)
+	delete(m, vaddr)
+	c.senders.Store(&m)
+}
+
+// sender returns the peer with virtual address vaddr, nil if unknown. Its state
+// belongs to its loop, other goroutines only use its send key.
+func (c *Conn) sender(vaddr uint16) *peer {
+	if m := c.senders.Load(); m != nil {
+		return (*m)[vaddr]
+	}
+	return nil
+}
+
+// lookup returns the peer and the send key for dst, if there is a session.
+func (c *Conn) lookup(dst uint16) (*peer, *sendKey) {
+	if p := c.sender(dst); p != nil {
+		if k := p.tx.Load(); k != nil {
+			return p, k
+		}
+	}
+	if c.via != nil {
+		if k := c.via.tx.Load(); k != nil {
+			return c.via, k
+		}
+	}
+	return nil, nil
+}
+
+// call runs f in the connection loop, which owns the state of the peers.
+func (c *Conn) call(f func()) error {
+	return c.callOn(c.ch.calls, f)
+}
+
+// callOn runs f in the loop reading calls.
+func (c *Conn) callOn(calls chan func(), f func()) error {
+	done := make(chan struct{})
+	select {
+	case calls <- func() { f(); close(done) }:
+		<-done
+		return nil
+	case <-c.ch.done:
+		return ErrClosed
+	}
+}
+
+// deliver is called from the connection loop for every data message received.
+func (c *Conn) deliver(msg *message) {
+	if msg.kind == typeStream {
+		// Streams keep the segments received out of order
+		if mux := c.mux.Load(); mux != nil {
+			mux.input(msg.detach())
+		} else {
+			msg.release()
+		}
+		return
+	}
+	if msg.port != DefaultPort {
+		if e := c.ports.deliver(msg); e != nil {
+			c.discard(msg, e.Error())
+		}
+		return
+	}
+	c.enqueue(msg)
+}
+
+func (c *Conn) streams() *streamMux {
+	c.muxOnce.Do(func() {
+		c.mux.Store(newStreamMux(c))
+	})
+	return c.mux.Load()
+}
+
+// resetStreams aborts the streams to the addresses matched after the session
+// carrying them is lost. Every stream of a client rides its session with the
+// server, which resets them all with allStreams.
+func (c *Conn) resetStreams(match func(addr uint16) bool) {
+	if mux := c.mux.Load(); mux != nil {
+		mux.reset(match)
+	}
+}
+
+func allStreams(uint16) bool { return true }
+
+// release wakes up every user of the streams and channels of a closed connection.
+func (c *Conn) release() {
+	if mux := c.mux.Load(); mux != nil {
+		mux.close()
+	}
+	c.ports.close()
 }
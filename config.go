@@ -27,11 +27,18 @@ type LocalConfig struct {
 }
 
 type RemoteConfig struct {
-	VirtualAddress int     `json:"virtual_address"`
-	NetworkAddress *string `json:"network_address,omitempty"`
-	SharedHmacKey  *string `json:"shared_hmac_key,omitempty"`
-	KeyType        *string `json:"key_type,omitempty"`
-	PublicKey      string  `json:"public_key"`
+	VirtualAddress int              `json:"virtual_address"`
+	NetworkAddress *string          `json:"network_address,omitempty"`
+	Endpoints      []EndpointConfig `json:"endpoints,omitempty"`
+	SharedHmacKey  *string          `json:"shared_hmac_key,omitempty"`
+	KeyType        *string          `json:"key_type,omitempty"`
+	PublicKey      string           `json:"public_key"`
+	ACL            *ACLConfig       `json:"acl,omitempty"`
+}
+
+type EndpointConfig struct {
+	NetworkAddress string `json:"network_address"`
+	Weight         int    `json:"weight,omitempty"`
 }
 
 type Attributes struct {
@@ -92,16 +99,26 @@ func (config *ClientConfig) ServerAddress() (*RemoteAddr, error) {
 	var (
 		sharedHmac []byte
 		pubk       *ecdsa.PublicKey
+		addr       *net.UDPAddr
+		endpoints  []Endpoint
 		err        error
 	)
 
-	if config.Server.NetworkAddress == nil {
+	if config.Server.NetworkAddress == nil && len(config.Server.Endpoints) == 0 {
 		return nil, fmt.Errorf("mandatory field is missing server.network_address")
 	}
 
-	addr, e := net.ResolveUDPAddr("udp4", *config.Server.NetworkAddress)
-	if e != nil {
-		return nil, e
+	if config.Server.NetworkAddress != nil {
+		if addr, err = net.ResolveUDPAddr("udp4", *config.Server.NetworkAddress); err != nil {
+			return nil, err
+		}
+	}
+	for _, ep := range config.Server.Endpoints {
+		a, e := net.ResolveUDPAddr("udp4", ep.NetworkAddress)
+		if e != nil {
+			return nil, e
+		}
+		endpoints = append(endpoints, Endpoint{NetworkAddress: a, Weight: ep.Weight})
 	}
 	if config.Server.KeyType == nil || *config.Server.KeyType == "file" {
 		pubk, err = PublicKeyFromPemFile(config.Server.PublicKey)
@@ -126,6 +143,7 @@ func (config *ClientConfig) ServerAddress() (*RemoteAddr, error) {
 	raddr := &RemoteAddr{
 		VirtualAddress: uint16(config.Server.VirtualAddress),
 		NetworkAddress: addr,
+		Endpoints:      endpoints,
 		PublicKey:      pubk,
 		SharedHmacKey:  sharedHmac,
 	}
@@ -207,6 +225,9 @@ func (config *ServerConfig) LocalAddress() (*LocalAddr, error) {
 		priv *ecdsa.PrivateKey
 		err  error
 	)
+	if config.Server.NetworkAddress == nil {
+		return nil, fmt.Errorf("mandatory field is missing local.network_address")
+	}
 	addr, e := net.ResolveUDPAddr("udp4", *config.Server.NetworkAddress)
 	if e != nil {
 		return nil, e
@@ -242,6 +263,8 @@ func (config *ServerConfig) PeersAddresses() ([]*RemoteAddr, error) {
 		var (
 			sharedHmac []byte
 			pubk       *ecdsa.PublicKey
+			acl        *ACL
+			addr       *net.UDPAddr
 			err        error
 		)
 		if peer.KeyType == nil || *peer.KeyType == "file" {
@@ -264,10 +287,25 @@ func (config *ServerConfig) PeersAddresses() ([]*RemoteAddr, error) {
 			sharedHmac = []byte(*peer.SharedHmacKey)
 		}
 
+		if peer.ACL != nil {
+			if acl, err = peer.ACL.acl(); err != nil {
+				return nil, fmt.Errorf("peer %d: %v", peer.VirtualAddress, err)
+			}
+		}
+
+		// Static endpoints are used by nodes of a mesh
+		if peer.NetworkAddress != nil {
+			if addr, err = net.ResolveUDPAddr("udp4", *peer.NetworkAddress); err != nil {
+				return nil, fmt.Errorf("peer %d: %v", peer.VirtualAddress, err)
+			}
+		}
+
 		raddr = append(raddr, &RemoteAddr{
 			VirtualAddress: uint16(peer.VirtualAddress),
 			PublicKey:      pubk,
 			SharedHmacKey:  sharedHmac,
+			NetworkAddress: addr,
+			ACL:            acl,
 		})
 	}
 
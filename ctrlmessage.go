@@ -10,9 +10,13 @@ const ctrlmessagesz = 24 + 4 + 8 + 64
 
 const (
 	KeepAlive    uint32 = 1 << 0 // Bit 0
-	RTT          uint32 = 1 << 1 // Bit 1
+	RTT          uint32 = 1 << 1 // Bit 1, data: sender time
 	KeepAliveAck uint32 = 1 << 2 // Bit 2
 	EpochAck     uint32 = 1 << 3 // Bit 3
+	Rendezvous   uint32 = 1 << 4 // Bit 4, data: requested peer
+	Introduce    uint32 = 1 << 5 // Bit 5, data: peer endpoint
+	Close        uint32 = 1 << 6 // Bit 6, session closed by the sender, data: reason code
+	RTTAck       uint32 = 1 << 7 // Bit 7, data: echoed from RTT
 )
 
 type ctrlmessage struct {
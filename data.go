@@ -1,33 +1,39 @@
 package sudp
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 type data struct {
 	hmac [24]byte
+	port uint16
 	buff []byte
 }
 
 const (
-	dataOverload  = 12 + 16 + 24
+	dataOverload  = 12 + 16 + 24 + 2
 	DataHeaderLen = dataOverload
 )
 
-func (d *data) dump(cipher *dhss, dst []byte) error {
+// dump seals the data into dst in place: the nonce followed by the encrypted
+// hmac, port and buffer.
+func (d *data) dump(aead cipher.AEAD, dst []byte) error {
 	if len(dst) < len(d.buff)+dataOverload {
-		fmt.Errorf("dst to small to dump data")
+		return fmt.Errorf("dst to small to dump data")
 	}
-	// Push data
-	copy(dst[0:24], d.hmac[:])
-	copy(dst[24:], d.buff)
-
-	c, e := cipher.encrypt(dst[0 : len(d.buff)+24])
-	if e != nil {
+	nonce := dst[0:12]
+	if _, e := io.ReadFull(rand.Reader, nonce); e != nil {
 		return e
 	}
-	copy(dst[0:12], c.nonce)
-	copy(dst[12:], c.ctext)
+	plain := dst[12 : 12+26+len(d.buff)]
+	copy(plain[0:24], d.hmac[:])
+	binary.BigEndian.PutUint16(plain[24:], d.port)
+	copy(plain[26:], d.buff)
+	aead.Seal(plain[:0], nonce, plain, nil)
 	return nil
 }
 
@@ -35,20 +41,22 @@ func (d *data) size() uint16 {
 	return uint16(len(d.buff) + dataOverload)
 }
 
-func loadData(b []byte, cipher *dhss) (*data, error) {
+// loadData decrypts b in place, the buffer of the data points into b.
+func loadData(b []byte, cipher *dhss) (data, error) {
 	if cipher == nil {
-		return nil, fmt.Errorf("nil key")
+		return data{}, fmt.Errorf("nil key")
 	}
-	d, e := cipher.decrypt(&crypted{
-		nonce: b[0:12],
-		ctext: b[12:],
-	})
+	d, e := cipher.open(b)
 	if e != nil {
-		return nil, e
+		return data{}, e
+	}
+	if len(d) < 26 {
+		return data{}, fmt.Errorf("invalid data size")
 	}
 	data := data{
-		buff: d[24:],
+		port: binary.BigEndian.Uint16(d[24:]),
+		buff: d[26:],
 	}
 	copy(data.hmac[:], d[0:24])
-	return &data, nil
+	return data, nil
 }
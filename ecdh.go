@@ -6,7 +6,6 @@ import (
 	"crypto/ecdh"
 	"crypto/rand"
 	"fmt"
-	"io"
 )
 
 const (
@@ -17,11 +16,7 @@ type dhss struct {
 	curve  ecdh.Curve
 	pk     *ecdh.PrivateKey
 	shared []byte
-}
-
-type crypted struct {
-	nonce []byte
-	ctext []byte
+	aead   cipher.AEAD // Built from the shared secret, safe for concurrent use
 }
 
 func newCipher() (*dhss, error) {
@@ -37,6 +32,14 @@ func newCipher() (*dhss, error) {
 	return &c, nil
 }
 
+// wipe clears the key material, the cipher can not be used afterwards.
+func (c *dhss) wipe() {
+	clear(c.shared)
+	c.shared = nil
+	c.pk = nil
+	c.aead = nil
+}
+
 func (c *dhss) public() []byte {
 	return c.pk.PublicKey().Bytes()
 }
@@ -54,50 +57,22 @@ func (c *dhss) ecdh(remote []byte) error {
 	if e != nil {
 		return e
 	}
-	return nil
-}
-
-func (c *dhss) encrypt(data []byte) (crypted, error) {
-	block, err := aes.NewCipher(c.shared)
-	if err != nil {
-		return crypted{}, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return crypted{}, err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return crypted{}, err
+	block, e := aes.NewCipher(c.shared)
+	if e != nil {
+		return e
 	}
-
-	ciphertext := gcm.Seal(nil, nonce, data, nil)
-	return crypted{
-		nonce: nonce,
-		ctext: ciphertext,
-	}, nil
+	c.aead, e = cipher.NewGCM(block)
+	return e
 }
 
-func (c *dhss) decrypt(ctext *crypted) ([]byte, error) {
-	block, err := aes.NewCipher(c.shared)
-	if err != nil {
-		return nil, err
+// open decrypts b, the nonce followed by the ciphertext, in place.
+func (c *dhss) open(b []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, fmt.Errorf("key not ready")
 	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	n := c.aead.NonceSize()
+	if len(b) < n+c.aead.Overhead() {
+		return nil, fmt.Errorf("invalid data size")
 	}
-
-	if len(ctext.nonce) != gcm.NonceSize() {
-		return nil, fmt.Errorf("invalid nonce size")
-	}
-	plaintext, err := gcm.Open(nil, ctext.nonce, ctext.ctext, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return plaintext, nil
+	return c.aead.Open(b[n:n], b[:n], b[n:], nil)
 }
@@ -2,13 +2,15 @@ package sudp
 
 import (
 	"fmt"
+	"time"
 )
 
 type epochs struct {
 	edkeys map[int]*dhss
-	pEpoch int // Prev Epoch
-	cEpoch int // Current Epoch
-	nEpoch int // Next Epoch
+	pEpoch int       // Prev Epoch
+	cEpoch int       // Current Epoch
+	nEpoch int       // Next Epoch
+	ctime  time.Time // Promotion time of the current epoch
 }
 
 func (e *epochs) init() {
@@ -16,6 +18,15 @@ func (e *epochs) init() {
 	e.pEpoch = -1
 	e.cEpoch = -1
 	e.nEpoch = -1
+	e.ctime = time.Time{}
+}
+
+// wipe clears the keys of every epoch and starts over.
+func (e *epochs) wipe() {
+	for _, key := range e.edkeys {
+		key.wipe()
+	}
+	e.init()
 }
 
 func (e *epochs) new(epoch int) (*dhss, error) {
@@ -79,7 +90,17 @@ func (e *epochs) promote(n int) error {
 		e.pEpoch = e.cEpoch
 		e.cEpoch = e.nEpoch
 		e.nEpoch = -1
+		e.ctime = time.Now()
 		return nil
 	}
 	return fmt.Errorf("impossible to promote next key. cEpoch: %d, nEpoch: %d, n: %d", e.cEpoch, e.nEpoch, n)
 }
+
+// expire drops the previous epoch once grace has passed since the promotion of
+// the current one. With no grace it is kept until the next promotion.
+func (e *epochs) expire(grace time.Duration) {
+	if grace > 0 && e.pEpoch != -1 && time.Since(e.ctime) > grace {
+		delete(e.edkeys, e.pEpoch)
+		e.pEpoch = -1
+	}
+}
@@ -1,6 +1,22 @@
 package sudp
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrClosed           = errors.New("connection closed")
+	ErrNotReady         = errors.New("not ready")
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+	ErrUnknownPeer      = errors.New("unknown peer")
+	ErrMessageTooLarge  = errors.New("message too large")
+	ErrSessionLost      = errors.New("session lost")
+	ErrUnexpectedClose  = errors.New("unexpected close")
+	ErrStreamTimeout    = errors.New("retransmission timeout")
+	ErrStreamReset      = errors.New("connection reset by peer")
+)
 
 type Err struct {
 	message string
@@ -21,3 +37,47 @@ func (e *Err) Error() string {
 		return fmt.Sprintf("%s", e.message)
 	}
 }
+
+func (e *Err) Unwrap() error {
+	return e.err
+}
+
+// DropError is the error of a received packet discarded by a connection.
+type DropError struct {
+	Reason         DropReason
+	VirtualAddress int // Source peer, -1 when unknown
+	Err
+}
+
+func newDrop(reason DropReason, m string, e error) error {
+	return &DropError{Reason: reason, VirtualAddress: -1, Err: Err{message: m, err: e}}
+}
+
+// HandshakeError is the error of a handshake that failed or was not answered.
+type HandshakeError struct {
+	VirtualAddress uint16
+	NetworkAddress *net.UDPAddr
+	Err            error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake with %d at %v, %v", e.VirtualAddress, e.NetworkAddress, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// CloseError is the error of a session closed by the server. It matches
+// ErrClosed.
+type CloseError struct {
+	Reason CloseReason
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closed by the server: %v", e.Reason)
+}
+
+func (e *CloseError) Unwrap() error {
+	return ErrClosed
+}
@@ -0,0 +1,98 @@
+package sudp
+
+import (
+	"fmt"
+	"net"
+)
+
+type EventKind int
+
+const (
+	PeerUp          EventKind = iota // Session established with the peer
+	PeerDown                         // Session closed, see Reason
+	EpochRotated                     // New current epoch
+	AddressChanged                   // Peer roamed to a new network address
+	HandshakeFailed                  // Invalid handshake from the peer, see Reason
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case PeerUp:
+		return "peer-up"
+	case PeerDown:
+		return "peer-down"
+	case EpochRotated:
+		return "epoch-rotated"
+	case AddressChanged:
+		return "address-changed"
+	case HandshakeFailed:
+		return "handshake-failed"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is a change in the session with a peer of a ServerConn.
+type Event struct {
+	Kind           EventKind
+	VirtualAddress uint16
+	NetworkAddress *net.UDPAddr
+	Epoch          int // Current epoch, -1 if none
+	Reason         string
+	Code           CloseReason // Close reason of PeerDown events
+	Err            error       // Cause of HandshakeFailed events, a *HandshakeError
+}
+
+// peerstate is the part of a peer tracked to emit events.
+type peerstate struct {
+	ready bool
+	epoch int
+	naddr *net.UDPAddr
+}
+
+func (p *peer) track() peerstate {
+	return peerstate{ready: p.ready, epoch: p.epochs.cEpoch, naddr: p.naddr}
+}
+
+func (s *ServerConn) emit(kind EventKind, p *peer, naddr *net.UDPAddr, reason string) {
+	if s.opts.Events == nil {
+		return
+	}
+	s.opts.Events(Event{
+		Kind:           kind,
+		VirtualAddress: p.vaddr,
+		NetworkAddress: naddr,
+		Epoch:          p.epochs.cEpoch,
+		Reason:         reason,
+	})
+}
+
+// handshakeFailed emits HandshakeFailed with the error of the handshake.
+func (s *ServerConn) handshakeFailed(p *peer, naddr *net.UDPAddr, e error) {
+	if s.opts.Events == nil {
+		return
+	}
+	s.opts.Events(Event{
+		Kind:           HandshakeFailed,
+		VirtualAddress: p.vaddr,
+		NetworkAddress: naddr,
+		Epoch:          p.epochs.cEpoch,
+		Reason:         e.Error(),
+		Err:            &HandshakeError{VirtualAddress: p.vaddr, NetworkAddress: naddr, Err: e},
+	})
+}
+
+// changed emits the events between a previous state of p and the current one.
+func (s *ServerConn) changed(p *peer, prev peerstate) {
+	if s.opts.Events == nil {
+		return
+	}
+	if prev.ready && prev.naddr != nil && p.naddr != nil && p.naddr != prev.naddr {
+		s.emit(AddressChanged, p, p.naddr, fmt.Sprintf("from %s", prev.naddr))
+	}
+	if !prev.ready && p.ready {
+		s.emit(PeerUp, p, p.naddr, "")
+	}
+	if prev.epoch != -1 && p.epochs.cEpoch != -1 && p.epochs.cEpoch != prev.epoch {
+		s.emit(EpochRotated, p, p.naddr, "")
+	}
+}
@@ -0,0 +1,177 @@
+package sudp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// roamingProxy forwards a client to a server from an upstream socket that can
+// be replaced, as a client behind a NAT whose mapping changes.
+type roamingProxy struct {
+	conn   *net.UDPConn // Facing the client
+	server *net.UDPAddr
+	lock   sync.Mutex
+	up     *net.UDPConn // Facing the server
+	client *net.UDPAddr
+}
+
+func newRoamingProxy(t *testing.T, server *net.UDPAddr) *roamingProxy {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &roamingProxy{conn: conn, server: server}
+	t.Cleanup(func() {
+		conn.Close()
+		p.lock.Lock()
+		p.up.Close()
+		p.lock.Unlock()
+	})
+	p.roam(t)
+	go p.run()
+	return p
+}
+
+func (p *roamingProxy) run() {
+	b := make([]byte, pktbuffSize)
+	for {
+		n, from, err := p.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		p.lock.Lock()
+		p.client = from
+		up := p.up
+		p.lock.Unlock()
+		up.WriteToUDP(b[:n], p.server)
+	}
+}
+
+// roam moves the upstream to a new socket and returns its address.
+func (p *roamingProxy) roam(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	up, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.lock.Lock()
+	if p.up != nil {
+		p.up.Close()
+	}
+	p.up = up
+	p.lock.Unlock()
+	go func() {
+		b := make([]byte, pktbuffSize)
+		for {
+			n, err := up.Read(b)
+			if err != nil {
+				return
+			}
+			p.lock.Lock()
+			client := p.client
+			p.lock.Unlock()
+			p.conn.WriteToUDP(b[:n], client)
+		}
+	}()
+	return up.LocalAddr().(*net.UDPAddr)
+}
+
+// The events of a peer carry its virtual address and the network address of
+// the change.
+func TestEvents(t *testing.T) {
+	events := make(chan Event, 256)
+	skey, _ := GenerateKey()
+	ckey, _ := GenerateKey()
+	hmkey := []byte("test hmac key")
+	srv, err := Listen(&LocalAddr{PrivateKey: skey, NetworkAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		[]*RemoteAddr{{VirtualAddress: 1, PublicKey: &ckey.PublicKey, SharedHmacKey: hmkey}},
+		&ServerOpts{Events: func(e Event) { events <- e }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	proxy := newRoamingProxy(t, srv.conns[0].LocalAddr().(*net.UDPAddr))
+	proxy.lock.Lock()
+	naddr := proxy.up.LocalAddr().(*net.UDPAddr)
+	proxy.lock.Unlock()
+
+	// next returns the next event of kind, skipping the others
+	next := func(kind EventKind) Event {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Kind == kind {
+					if e.VirtualAddress != 1 {
+						t.Fatalf("%v of %d, want 1", kind, e.VirtualAddress)
+					}
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("no %v event", kind)
+			}
+		}
+	}
+	sameAddr := func(e Event, want *net.UDPAddr) {
+		t.Helper()
+		if e.NetworkAddress == nil || e.NetworkAddress.String() != want.String() {
+			t.Fatalf("%v at %v, want %v", e.Kind, e.NetworkAddress, want)
+		}
+	}
+
+	cli, err := Connect(&LocalAddr{VirtualAddress: 1, PrivateKey: ckey},
+		&RemoteAddr{PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: proxy.conn.LocalAddr().(*net.UDPAddr)},
+		&ClientOpts{KeepAliveInterval: 20 * time.Millisecond, HandshakeRetry: 50 * time.Millisecond, EpochLifetime: 150 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	up := next(PeerUp)
+	sameAddr(up, naddr)
+
+	rotated := next(EpochRotated)
+	sameAddr(rotated, naddr)
+	if rotated.Epoch == up.Epoch || rotated.Epoch == -1 {
+		t.Fatalf("rotated to epoch %d from %d", rotated.Epoch, up.Epoch)
+	}
+
+	roamed := proxy.roam(t)
+	changed := next(AddressChanged)
+	sameAddr(changed, roamed)
+	if !strings.Contains(changed.Reason, naddr.String()) {
+		t.Fatalf("address change reason %q without %v", changed.Reason, naddr)
+	}
+
+	// A handshake of vaddr 1 signed with another key, from a known address
+	reserved, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := reserved.LocalAddr().(*net.UDPAddr)
+	reserved.Close()
+	wrong, _ := GenerateKey()
+	if _, err := Connect(&LocalAddr{VirtualAddress: 1, PrivateKey: wrong, NetworkAddress: impostor},
+		&RemoteAddr{PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: srv.conns[0].LocalAddr().(*net.UDPAddr)},
+		&ClientOpts{Tries: 1, KeepAliveInterval: 20 * time.Millisecond, HandshakeRetry: 50 * time.Millisecond}); err == nil {
+		t.Fatal("handshake with a wrong key accepted")
+	}
+	failed := next(HandshakeFailed)
+	sameAddr(failed, impostor)
+	var he *HandshakeError
+	if !errors.As(failed.Err, &he) || he.VirtualAddress != 1 {
+		t.Fatalf("handshake failure error %v", failed.Err)
+	}
+
+	cli.Close()
+	down := next(PeerDown)
+	sameAddr(down, roamed)
+	if down.Code != CloseNormal || down.Reason != "closed by peer: closed" {
+		t.Fatalf("peer down with %v, %q", down.Code, down.Reason)
+	}
+}
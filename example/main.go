@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"sudp"
 	"time"
 )
@@ -28,7 +29,7 @@ func main() {
 			return
 		}
 
-		server, err := sudp.Listen(laddr, raddr)
+		server, err := sudp.Listen(laddr, raddr, &sudp.ServerOpts{Logger: slog.Default()})
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -60,7 +61,7 @@ func main() {
 		}
 		fmt.Println(laddr.String())
 		fmt.Println(raddr.String())
-		conn, err := sudp.Connect(laddr, raddr, nil)
+		conn, err := sudp.Connect(laddr, raddr, &sudp.ClientOpts{Logger: slog.Default()})
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -2,6 +2,9 @@ module github.com/tunelo/sudp
 
 go 1.22.4
 
-require golang.org/x/crypto v0.29.0
+require (
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.31.0
+)
 
-require golang.org/x/sys v0.27.0 // indirect
+require golang.org/x/sys v0.27.0
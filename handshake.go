@@ -26,16 +26,17 @@ func (h handshake) String() string {
 
 type handshakestate struct {
 	tries    int
+	started  time.Time
 	senttime time.Time
 	hdr      hdr
 	msg      handshake
 }
 
-func (h *handshakestate) timeRetry(rtime int) bool {
-	return time.Now().Sub(h.senttime) > time.Duration(rtime)*time.Second
+func (h *handshakestate) timeRetry(rtime time.Duration) bool {
+	return time.Now().Sub(h.senttime) > rtime
 }
 
-func (h *handshakestate) repack(key *ecdsa.PrivateKey, hmkey []byte) (*pktbuff, error) {
+func (h *handshakestate) repack(key *ecdsa.PrivateKey, hmkey *hmacKey) (*pktbuff, error) {
 	packet := allocPktbuff()
 	h.hdr.hmac = [24]byte{}
 	h.hdr.time = uint64(time.Now().UnixMicro())
@@ -22,8 +22,8 @@ type hdr struct {
 	hmac  [24]byte
 }
 
-func newHdr(kind uint8, epoch uint32, src, dst uint16) *hdr {
-	h := hdr{
+func newHdr(kind uint8, epoch uint32, src, dst uint16) hdr {
+	return hdr{
 		ver:   protocolVersion,
 		kind:  kind,
 		epoch: epoch,
@@ -31,19 +31,18 @@ func newHdr(kind uint8, epoch uint32, src, dst uint16) *hdr {
 		dst:   dst,
 		time:  uint64(time.Now().UnixMicro()),
 	}
-	return &h
 }
 
 func hdrSrcDst(b []byte) (uint16, uint16) {
 	return binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:])
 }
 
-func hdrLoad(b []byte, hmkey []byte) (*hdr, error) {
+func hdrLoad(b []byte, hmkey *hmacKey) (hdr, error) {
 	if len(b) < hdrsz {
-		return nil, fmt.Errorf("invalid buffer size")
+		return hdr{}, fmt.Errorf("invalid buffer size")
 	}
 	crc := blake192Hmac(b, hmkey) //hmac.ChecksumIEEE(b)
-	h := &hdr{
+	h := hdr{
 		ver:   b[0],
 		kind:  b[1],
 		len:   binary.BigEndian.Uint16(b[2:]),
@@ -54,18 +53,19 @@ func hdrLoad(b []byte, hmkey []byte) (*hdr, error) {
 		hmac:  crc,
 	}
 	if h.ver != protocolVersion {
-		return nil, fmt.Errorf("invalid protocol")
+		return hdr{}, fmt.Errorf("invalid protocol")
 	}
 	if h.kind != typeClientHandshake &&
 		h.kind != typeServerHandshake &&
 		h.kind != typeCtrlMessage &&
-		h.kind != typeData {
-		return nil, fmt.Errorf("invalid message")
+		h.kind != typeData &&
+		h.kind != typeStream {
+		return hdr{}, fmt.Errorf("invalid message")
 	}
 	return h, nil
 }
 
-func (h *hdr) dump(b []byte, hmkey []byte) error {
+func (h *hdr) dump(b []byte, hmkey *hmacKey) error {
 	if b == nil || len(b) < hdrsz {
 		return fmt.Errorf("invalid buffer size")
 	}
@@ -0,0 +1,71 @@
+package sudp
+
+import (
+	"slices"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Histogram is a distribution of latencies. Counts are cumulative: Counts[i]
+// is the number of observations lower or equal than Buckets[i].
+type Histogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+type histogram struct {
+	counts [len(latencyBuckets)]uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	for i, b := range latencyBuckets {
+		if d <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) add(o *histogram) {
+	for i := range h.counts {
+		h.counts[i] += o.counts[i]
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+func (h *histogram) export() Histogram {
+	e := Histogram{
+		Buckets: slices.Clone(latencyBuckets[:]),
+		Counts:  make([]uint64, len(latencyBuckets)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+	var acc uint64
+	for i, n := range h.counts {
+		acc += n
+		e.Counts[i] = acc
+	}
+	return e
+}
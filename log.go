@@ -1,20 +1,102 @@
 package sudp
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
 	"time"
 )
 
-// Definimos constantes para los niveles de log
+// Deprecated: the levels of the former stdout log, see the Logger option of
+// Listen, Connect and NewNode.
 const (
 	Info  = "sudp - info"
 	Error = "sudp - error"
 	Warn  = "sudp - warn"
 )
 
-// Función para el log
-func log(level string, message string) {
-	now := time.Now().Format("2006-01-02 15:04:05")
-	log := fmt.Sprintf("[%s] [%s]: %s", now, level, message)
-	fmt.Println(log)
+// dropLogInterval is the minimum time between two drop warnings with the same
+// reason, the ones in between are counted and reported with the next one.
+const dropLogInterval = time.Second
+
+// logger is the optional structured logger of a connection, nothing is logged
+// without one.
+type logger struct {
+	l     *slog.Logger
+	lock  sync.Mutex
+	drops map[string]*dropLog
+}
+
+type dropLog struct {
+	last       time.Time
+	suppressed int
+}
+
+func (l *logger) info(msg string, args ...any) {
+	l.log(slog.LevelInfo, msg, args...)
+}
+
+func (l *logger) warn(msg string, args ...any) {
+	l.log(slog.LevelWarn, msg, args...)
+}
+
+func (l *logger) log(level slog.Level, msg string, args ...any) {
+	if l.l == nil {
+		return
+	}
+	l.l.Log(context.Background(), level, msg, args...)
+}
+
+// drop logs a discarded packet or message, rate limited by reason.
+func (l *logger) drop(reason string, msg string, args ...any) {
+	if l.l == nil || !l.l.Enabled(context.Background(), slog.LevelWarn) {
+		return
+	}
+	l.lock.Lock()
+	if l.drops == nil {
+		l.drops = make(map[string]*dropLog)
+	}
+	d, ok := l.drops[reason]
+	if !ok {
+		d = &dropLog{}
+		l.drops[reason] = d
+	}
+	now := time.Now()
+	if now.Sub(d.last) < dropLogInterval {
+		d.suppressed++
+		l.lock.Unlock()
+		return
+	}
+	suppressed := d.suppressed
+	d.last, d.suppressed = now, 0
+	l.lock.Unlock()
+
+	args = append(args, "reason", reason)
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	l.warn(msg, args...)
+}
+
+// peerAttrs are the attributes identifying a peer and its session.
+func peerAttrs(p *peer) []any {
+	epoch, _ := p.epochs.current()
+	return []any{"vaddr", p.vaddr, "addr", p.naddr, "epoch", epoch}
+}
+
+// logDrop logs a received packet discarded by the connection, p is nil when
+// the source is unknown.
+func (c *Conn) logDrop(p *peer, addr *net.UDPAddr, e error) {
+	reason := "error"
+	var d *DropError
+	if errors.As(e, &d) {
+		reason = d.Reason.String()
+	}
+	args := []any{"addr", addr, "err", e}
+	if p != nil {
+		args = append(args, "vaddr", p.vaddr)
+	}
+	c.log.drop(reason, "packet dropped", args...)
 }
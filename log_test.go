@@ -0,0 +1,117 @@
+package sudp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capture is a slog.Handler keeping the records it handles.
+type capture struct {
+	lock    sync.Mutex
+	records []slog.Record
+}
+
+func (c *capture) Enabled(context.Context, slog.Level) bool { return true }
+func (c *capture) WithAttrs([]slog.Attr) slog.Handler       { return c }
+func (c *capture) WithGroup(string) slog.Handler            { return c }
+
+func (c *capture) Handle(_ context.Context, r slog.Record) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.records = append(c.records, r.Clone())
+	return nil
+}
+
+// messages returns the records with msg.
+func (c *capture) messages(msg string) []slog.Record {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var rs []slog.Record
+	for _, r := range c.records {
+		if r.Message == msg {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func attr(r slog.Record, key string) (v slog.Value) {
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v = a.Value
+			return false
+		}
+		return true
+	})
+	return v
+}
+
+// Drop warnings are logged once per interval and reason, with the count of the
+// ones suppressed in between.
+func TestLogDropRateLimit(t *testing.T) {
+	h := &capture{}
+	l := logger{l: slog.New(h)}
+	for range 5 {
+		l.drop("bad hmac", "packet dropped")
+	}
+	l.drop("denied", "packet dropped")
+	rs := h.messages("packet dropped")
+	if len(rs) != 2 || attr(rs[0], "reason").String() != "bad hmac" || attr(rs[1], "reason").String() != "denied" {
+		t.Fatalf("%d warnings logged, want one per reason", len(rs))
+	}
+	if rs[0].Level != slog.LevelWarn {
+		t.Fatalf("drop logged at %v", rs[0].Level)
+	}
+
+	l.drops["bad hmac"].last = time.Now().Add(-dropLogInterval)
+	l.drop("bad hmac", "packet dropped")
+	rs = h.messages("packet dropped")
+	if len(rs) != 3 || attr(rs[2], "suppressed").Int64() != 4 {
+		t.Fatalf("%d warnings, last one %v, want 4 suppressed", len(rs), rs[len(rs)-1])
+	}
+}
+
+// A connection drops junk packets with a single warning, and logs nothing,
+// not even to the default logger, without a Logger.
+func TestLogDrops(t *testing.T) {
+	def := &capture{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(def))
+	defer slog.SetDefault(prev)
+
+	h := &capture{}
+	for _, logged := range []bool{true, false} {
+		opts := &ServerOpts{}
+		if logged {
+			opts.Logger = slog.New(h)
+		}
+		srv, cli := newPair(t, opts, nil)
+		if err := cli.Send([]byte("up")); err != nil {
+			t.Fatal(err)
+		}
+		recvAll(t, srv, 1)
+		junk, err := net.DialUDP("udp4", nil, srv.conns[0].LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 10 {
+			junk.Write([]byte("junk"))
+		}
+		junk.Close()
+		waitFor(t, "the junk to be dropped", func() bool {
+			st, _ := srv.Stats()
+			return st.Drops[DropMalformed] == 10
+		})
+		srv.Close()
+	}
+	if rs := h.messages("packet dropped"); len(rs) != 1 {
+		t.Fatalf("%d drop warnings, want 1", len(rs))
+	}
+	if len(def.records) != 0 {
+		t.Fatalf("%d records in the default logger, first %q", len(def.records), def.records[0].Message)
+	}
+}
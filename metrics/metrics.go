@@ -0,0 +1,133 @@
+// Package metrics exposes the statistics of a sudp server in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tunelo/sudp"
+)
+
+// Handler returns an http.Handler serving the metrics of server, usually
+// registered at /metrics.
+func Handler(server *sudp.ServerConn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers, err := server.Peers()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		stats, err := server.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		b := bufio.NewWriter(w)
+		write(b, peers, &stats, time.Now())
+		b.Flush()
+	})
+}
+
+func write(w *bufio.Writer, peers []sudp.PeerInfo, stats *sudp.Stats, now time.Time) {
+	header(w, "sudp_peer_up", "gauge", "Whether the session with the peer is established.")
+	for _, p := range peers {
+		fmt.Fprintf(w, "sudp_peer_up{vaddr=\"%d\"} %d\n", p.VirtualAddress, b2i(p.Ready))
+	}
+	header(w, "sudp_peer_epoch_age_seconds", "gauge", "Time since the current epoch of the peer was promoted.")
+	for _, p := range peers {
+		if p.Epoch != -1 && !p.EpochStarted.IsZero() {
+			fmt.Fprintf(w, "sudp_peer_epoch_age_seconds{vaddr=\"%d\"} %s\n", p.VirtualAddress, seconds(now.Sub(p.EpochStarted)))
+		}
+	}
+	header(w, "sudp_peer_rtt_smoothed_seconds", "gauge", "Smoothed round trip time of the peer.")
+	for _, p := range peers {
+		if p.RTT > 0 {
+			fmt.Fprintf(w, "sudp_peer_rtt_smoothed_seconds{vaddr=\"%d\"} %s\n", p.VirtualAddress, seconds(p.RTT))
+		}
+	}
+
+	type counter struct {
+		name, help string
+		value      func(*sudp.Counters) uint64
+	}
+	for _, c := range []counter{
+		{"sudp_peer_received_packets_total", "Packets received from the peer.", func(c *sudp.Counters) uint64 { return c.RxPackets }},
+		{"sudp_peer_received_bytes_total", "Bytes received from the peer.", func(c *sudp.Counters) uint64 { return c.RxBytes }},
+		{"sudp_peer_sent_packets_total", "Packets sent to the peer.", func(c *sudp.Counters) uint64 { return c.TxPackets }},
+		{"sudp_peer_sent_bytes_total", "Bytes sent to the peer.", func(c *sudp.Counters) uint64 { return c.TxBytes }},
+		{"sudp_peer_epoch_rotations_total", "Epoch rotations of the peer.", func(c *sudp.Counters) uint64 { return c.EpochRotations }},
+	} {
+		header(w, c.name, "counter", c.help)
+		for _, p := range stats.Peers {
+			fmt.Fprintf(w, "%s{vaddr=\"%d\"} %d\n", c.name, p.VirtualAddress, c.value(&p.Counters))
+		}
+	}
+
+	header(w, "sudp_peer_handshakes_total", "counter", "Handshakes with the peer by result.")
+	for _, p := range stats.Peers {
+		fmt.Fprintf(w, "sudp_peer_handshakes_total{vaddr=\"%d\",result=\"initiated\"} %d\n", p.VirtualAddress, p.HandshakesInitiated)
+		fmt.Fprintf(w, "sudp_peer_handshakes_total{vaddr=\"%d\",result=\"completed\"} %d\n", p.VirtualAddress, p.HandshakesCompleted)
+		fmt.Fprintf(w, "sudp_peer_handshakes_total{vaddr=\"%d\",result=\"failed\"} %d\n", p.VirtualAddress, p.HandshakesFailed)
+	}
+
+	header(w, "sudp_peer_drops_total", "counter", "Packets from the peer dropped by reason.")
+	for _, p := range stats.Peers {
+		for _, r := range reasons(p.Drops) {
+			fmt.Fprintf(w, "sudp_peer_drops_total{vaddr=\"%d\",reason=%s} %d\n", p.VirtualAddress, strconv.Quote(r.String()), p.Drops[r])
+		}
+	}
+	header(w, "sudp_drops_total", "counter", "Packets dropped by the server by reason, unknown sources included.")
+	for _, r := range reasons(stats.Drops) {
+		fmt.Fprintf(w, "sudp_drops_total{reason=%s} %d\n", strconv.Quote(r.String()), stats.Drops[r])
+	}
+	header(w, "sudp_recv_drops_total", "counter", "Received messages not delivered to a full receive queue or an unbound or full channel.")
+	fmt.Fprintf(w, "sudp_recv_drops_total %d\n", stats.RecvDrops)
+
+	header(w, "sudp_peer_rtt_seconds", "histogram", "Round trip time samples of the peer.")
+	for _, p := range stats.Peers {
+		histogram(w, "sudp_peer_rtt_seconds", p.VirtualAddress, &p.RTT)
+	}
+	header(w, "sudp_peer_handshake_duration_seconds", "histogram", "Duration of the handshakes with the peer.")
+	for _, p := range stats.Peers {
+		histogram(w, "sudp_peer_handshake_duration_seconds", p.VirtualAddress, &p.HandshakeLatency)
+	}
+}
+
+func header(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func histogram(w *bufio.Writer, name string, vaddr uint16, h *sudp.Histogram) {
+	for i, b := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{vaddr=\"%d\",le=\"%s\"} %d\n", name, vaddr, seconds(b), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{vaddr=\"%d\",le=\"+Inf\"} %d\n", name, vaddr, h.Count)
+	fmt.Fprintf(w, "%s_sum{vaddr=\"%d\"} %s\n", name, vaddr, seconds(h.Sum))
+	fmt.Fprintf(w, "%s_count{vaddr=\"%d\"} %d\n", name, vaddr, h.Count)
+}
+
+func reasons(drops map[sudp.DropReason]uint64) []sudp.DropReason {
+	r := make([]sudp.DropReason, 0, len(drops))
+	for k := range drops {
+		r = append(r, k)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+	return r
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tunelo/sudp"
+)
+
+// scrape returns the samples served at url, by name with labels.
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %q", ct)
+	}
+	samples := make(map[string]float64)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestHandler(t *testing.T) {
+	skey, _ := sudp.GenerateKey()
+	keys := make([]*ecdsa.PrivateKey, 2)
+	var raddrs []*sudp.RemoteAddr
+	hmkey := []byte("metrics hmac key")
+	for i := range keys {
+		keys[i], _ = sudp.GenerateKey()
+		raddrs = append(raddrs, &sudp.RemoteAddr{VirtualAddress: uint16(i + 1), PublicKey: &keys[i].PublicKey,
+			SharedHmacKey: hmkey, ACL: &sudp.ACL{MaxSize: 8}})
+	}
+	// Reserve a free port for the server
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+	srv, err := sudp.Listen(&sudp.LocalAddr{PrivateKey: skey, NetworkAddress: laddr}, raddrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cli, err := sudp.Connect(&sudp.LocalAddr{VirtualAddress: 1, PrivateKey: keys[0]},
+		&sudp.RemoteAddr{PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: laddr},
+		&sudp.ClientOpts{KeepAliveInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Send([]byte("allowed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Send([]byte("denied by size")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.RecvFrom(); err != nil {
+		t.Fatal(err)
+	}
+	// A packet too short for a header, dropped before knowing its source
+	junk, err := net.DialUDP("udp4", nil, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk.Write([]byte("junk"))
+	junk.Close()
+
+	ts := httptest.NewServer(Handler(srv))
+	defer ts.Close()
+	var m map[string]float64
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m = scrape(t, ts.URL)
+		if m[`sudp_peer_drops_total{vaddr="1",reason="denied"}`] == 1 && m[`sudp_drops_total{reason="malformed"}`] >= 1 &&
+			m[`sudp_peer_rtt_seconds_count{vaddr="1"}`] >= 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics not updated: %v", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for name, want := range map[string]float64{
+		`sudp_peer_up{vaddr="1"}`:                                          1,
+		`sudp_peer_up{vaddr="2"}`:                                          0,
+		`sudp_peer_drops_total{vaddr="1",reason="denied"}`:                 1,
+		`sudp_peer_handshakes_total{vaddr="1",result="completed"}`:         1,
+		`sudp_peer_handshakes_total{vaddr="2",result="completed"}`:         0,
+		`sudp_peer_handshake_duration_seconds_bucket{vaddr="2",le="+Inf"}`: 0,
+	} {
+		if got, ok := m[name]; !ok || got != want {
+			t.Errorf("%s = %v (%v), want %v", name, got, ok, want)
+		}
+	}
+	for _, name := range []string{
+		`sudp_peer_received_packets_total{vaddr="1"}`,
+		`sudp_peer_sent_packets_total{vaddr="1"}`,
+		`sudp_peer_epoch_age_seconds{vaddr="1"}`,
+		`sudp_peer_rtt_smoothed_seconds{vaddr="1"}`,
+	} {
+		if m[name] <= 0 {
+			t.Errorf("%s = %v, want a positive value", name, m[name])
+		}
+	}
+	if _, ok := m[`sudp_peer_epoch_age_seconds{vaddr="2"}`]; ok {
+		t.Error("epoch age of a peer without session")
+	}
+
+	// Buckets are cumulative and end with the count
+	prefix := `sudp_peer_rtt_seconds_bucket{vaddr="1",le="`
+	var last float64
+	var bounds []float64
+	for name := range m {
+		if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, `"+Inf"}`) {
+			le, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(name, prefix), `"}`), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bounds = append(bounds, le)
+		}
+	}
+	if len(bounds) == 0 {
+		t.Fatal("no rtt buckets")
+	}
+	sort.Float64s(bounds)
+	for _, le := range bounds {
+		v := m[prefix+strconv.FormatFloat(le, 'g', -1, 64)+`"}`]
+		if v < last {
+			t.Fatalf("bucket le=%v has %v samples, less than the previous %v", le, v, last)
+		}
+		last = v
+	}
+	count := m[`sudp_peer_rtt_seconds_count{vaddr="1"}`]
+	if inf := m[prefix+`+Inf"}`]; inf != count || last > count {
+		t.Fatalf("+Inf bucket %v, last bucket %v, count %v", inf, last, count)
+	}
+}
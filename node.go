@@ -0,0 +1,356 @@
+package sudp
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Node is a symmetric endpoint of a mesh. Unlike ServerConn and ClientConn
+// any node may initiate the handshake with its peers. Peers with a static
+// network address are connected actively, the others are waited for.
+type Node struct {
+	peerMap map[uint16]*peer
+	static  map[uint16]*net.UDPAddr
+	opts    *NodeOpts
+	timers  timers
+	Conn
+}
+
+type NodeOpts struct {
+	Tries             int           // Handshake attempts, default 4
+	TimeRetry         int           // Deprecated: use HandshakeRetry
+	EpochChange       int           // Deprecated: use EpochLifetime
+	KeepAliveInterval time.Duration // Default 500ms
+	IdleTimeout       time.Duration // Peer silence before closing its session, default 5s
+	HandshakeRetry    time.Duration // Default 2s
+	EpochLifetime     time.Duration // Default 30s
+	PrevEpochGrace    time.Duration // Previous epoch accepted after a rotation, 0 until the next one
+	Logger            *slog.Logger  // Optional, nothing is logged without it
+	RecvQueue         *QueuePolicy  // Optional, 10 messages blocking the loop when full
+}
+
+func (n *Node) filterPacket(pkt *pktbuff) (*peer, *hdr, error) {
+	buf := pkt.head(hdrsz)
+	if buf == nil {
+		return nil, nil, newDrop(DropMalformed, "invalid size - message drop", nil)
+	}
+	src, dst := hdrSrcDst(buf)
+
+	peer, ok := n.peerMap[src]
+	if !ok || dst != n.vaddr {
+		return nil, nil, newDrop(DropUnknownSource, "invalid source - message drop", nil)
+	}
+	hdr, e := pkt.loadHdr(buf, peer.hmackey)
+	if e != nil {
+		return peer, nil, newDrop(DropMalformed, "invalid header - message drop", e)
+	}
+	if !peer.acl.allowSource(pkt.addr) {
+		return peer, nil, newDrop(DropDenied, fmt.Sprintf("acl: source %s of %d not allowed - message drop", pkt.addr, src), nil)
+	}
+	if e := peer.inTime(hdr); e != nil {
+		return peer, nil, e
+	}
+	return peer, hdr, nil
+}
+
+// collision resolves two handshakes started at once by both ends of a session.
+// The handshake of the node with the lowest virtual address wins, it returns
+// true when the received one must be ignored.
+func (n *Node) collision(p *peer, hdr *hdr) bool {
+	if hdr.kind != typeClientHandshake || p.handshake == nil {
+		return false
+	}
+	if n.vaddr < p.vaddr {
+		return true
+	}
+	p.handshake = nil
+	return false
+}
+
+func (n *Node) reset(p *peer) {
+	p.wipe()
+	p.naddr = n.static[p.vaddr]
+	p.handshake = nil
+	p.ready = false
+	p.tsync = nil
+	p.ttlm = time.Time{}
+	p.publish()
+	n.resetStreams(func(addr uint16) bool { return addr == p.vaddr })
+}
+
+// control handles the control messages received from the peers.
+func (n *Node) control(p *peer, c *ctrlmessage) error {
+	if c.isSet(Close) {
+		n.log.info("session closed by peer", append(peerAttrs(p), "reason", CloseReason(c.data))...)
+		n.reset(p)
+	}
+	return nil
+}
+
+// maintain is run by the control ticker for every peer: it connects the static
+// peers, retries handshakes, rotates epochs and sends keepalives.
+func (n *Node) maintain(p *peer) {
+	if p.handshake != nil {
+		if !p.handshake.timeRetry(n.timers.handshakeRetry(p)) {
+			return
+		}
+		if p.handshake.tries < n.opts.Tries {
+			if rsnd, e := p.handshake.repack(n.private, p.hmackey); e == nil {
+				rsnd.addr = p.naddr
+				p.send(rsnd, n.conn)
+			}
+			return
+		}
+		n.log.warn("handshake timeout", peerAttrs(p)...)
+		p.stats.hsFail++
+		p.handshake = nil
+		if !p.ready {
+			n.reset(p)
+		}
+	}
+	if p.ready && time.Since(p.ttlm) > n.timers.idle {
+		n.log.info("peer idle - session closed", append(peerAttrs(p), "idle", n.timers.idle)...)
+		n.reset(p)
+	}
+	p.epochs.expire(n.timers.grace)
+	switch {
+	case !p.ready && p.naddr != nil && n.static[p.vaddr] != nil:
+		p.initiate(&n.Conn, rand.Intn(65536))
+	case p.ready && p.epochs.cEpoch != -1:
+		// Only one end of the session rotates the epochs
+		if n.vaddr < p.vaddr && time.Since(p.epochs.ctime) > n.timers.lifetime {
+			p.initiate(&n.Conn, p.epochs.cEpoch+1)
+			return
+		}
+		p.probe(&n.Conn, uint32(p.epochs.cEpoch), KeepAlive)
+	}
+}
+
+func (n *Node) serve() {
+	control := time.NewTicker(n.timers.keepAlive)
+	for {
+		select {
+		case <-n.ch.exit:
+			goto exit
+		case pkt := <-n.ch.netRx:
+			if pkt == nil {
+				n.open.setStat(statClose)
+				n.err <- ErrUnexpectedClose
+				return
+			}
+			peer, hdr, e := n.filterPacket(pkt)
+			if e != nil {
+				n.dropped(peer, e)
+				n.logDrop(peer, pkt.addr, e)
+				pkt.release()
+				continue
+			}
+			if n.collision(peer, hdr) {
+				pkt.release()
+				continue
+			}
+			// The packet is released by handlePacket
+			addr := pkt.addr
+			e = peer.handlePacket(hdr, pkt, &n.Conn)
+			if e != nil {
+				n.dropped(peer, e)
+				n.logDrop(peer, addr, e)
+			}
+		case f := <-n.ch.calls:
+			f()
+		case e := <-n.ch.errNRx:
+			n.open.setStat(statClose)
+			n.err <- fmt.Errorf("at reception %w -> panic", e)
+			return
+		case msg := <-n.ch.userTx:
+			peer, ok := n.peerMap[msg.addr]
+			if !ok {
+				n.ch.errUTx <- fmt.Errorf("%w %d", ErrUnknownPeer, msg.addr)
+				continue
+			}
+			if !peer.ready || peer.epochs.cEpoch == -1 {
+				n.ch.errUTx <- ErrNotReady
+				continue
+			}
+			if e := peer.sendDataPacket(n.vaddr, msg, n.conn); e != nil {
+				n.ch.errUTx <- newError("sending data packet:", e)
+				continue
+			}
+			n.ch.errUTx <- nil
+		case <-control.C:
+			for _, peer := range n.peerMap {
+				n.maintain(peer)
+			}
+		}
+	}
+exit:
+	for _, peer := range n.peerMap {
+		peer.notify(&n.Conn, CloseNormal)
+	}
+	n.open.setStat(statClose)
+	n.release()
+	n.conn.Close()
+	for {
+		select {
+		case _, ok := <-n.ch.netRx:
+			if !ok {
+				n.err <- nil
+				n.ch.close()
+				return
+			}
+		case e, ok := <-n.ch.errNRx:
+			if ok {
+				n.err <- e
+				n.ch.close()
+				return
+			}
+		}
+	}
+}
+
+// NewNode starts a mesh node. The handshake with the peers is asynchronous,
+// SendTo fails until the session with the destination is ready.
+func NewNode(laddr *LocalAddr, raddrs []*RemoteAddr, opts *NodeOpts) (*Node, error) {
+	if laddr.PrivateKey == nil {
+		return nil, fmt.Errorf("private key not present")
+	}
+	if laddr.NetworkAddress == nil {
+		return nil, fmt.Errorf("network address not found")
+	}
+
+	if opts == nil {
+		opts = &NodeOpts{}
+	}
+	timers, err := newTimers(opts.KeepAliveInterval, opts.IdleTimeout, opts.HandshakeRetry,
+		opts.EpochLifetime, opts.PrevEpochGrace, opts.TimeRetry, opts.EpochChange)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tries <= 0 {
+		o := *opts
+		o.Tries = defaultTries
+		opts = &o
+	}
+	queue, err := queuePolicy(opts.RecvQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", laddr.NetworkAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	node := Node{
+		opts:   opts,
+		timers: timers,
+		Conn: Conn{
+			vaddr:   laddr.VirtualAddress,
+			conn:    conn,
+			writer:  newPktWriter(conn),
+			private: laddr.PrivateKey,
+			err:     make(chan error),
+			log:     logger{l: opts.Logger},
+			queue:   queue,
+		},
+		peerMap: make(map[uint16]*peer),
+		static:  make(map[uint16]*net.UDPAddr),
+	}
+
+	for _, addr := range raddrs {
+		if addr.PublicKey == nil {
+			continue
+		}
+		p := &peer{
+			vaddr:   addr.VirtualAddress,
+			pubkey:  addr.PublicKey,
+			hmackey: newHmacKey(addr.SharedHmacKey),
+			naddr:   addr.NetworkAddress,
+			acl:     addr.ACL,
+		}
+		p.epochs.init()
+		node.peerMap[addr.VirtualAddress] = p
+		node.addSender(p)
+		node.static[addr.VirtualAddress] = addr.NetworkAddress
+	}
+
+	node.onData = node.deliver
+	node.onCtrl = node.control
+	node.ch.init(conn, nil, queue.Size)
+	node.open.setStat(statOpen)
+	go node.serve()
+	return &node, nil
+}
+
+func (n *Node) Close() {
+	if n != nil && n.open.isOpen() {
+		n.ch.stop()
+		n.ch.exit <- true
+		<-n.err
+	}
+}
+
+func (n *Node) RecvFrom() ([]byte, uint16, error) {
+	if n == nil || !n.open.isOpen() {
+		return nil, 0, ErrClosed
+	}
+	return recvCopy(<-n.ch.userRx)
+}
+
+// RecvInto copies the next message into b and returns its size and source,
+// without allocating. If b is too small the message is truncated and
+// io.ErrShortBuffer is returned.
+func (n *Node) RecvInto(b []byte) (int, uint16, error) {
+	if n == nil || !n.open.isOpen() {
+		return 0, 0, ErrClosed
+	}
+	return recvInto(<-n.ch.userRx, b)
+}
+
+func (n *Node) SendTo(buff []byte, addr uint16) error {
+	if n == nil || !n.open.isOpen() {
+		return ErrClosed
+	}
+	return n.sendMessage(message{
+		kind: typeData,
+		buff: buff,
+		addr: addr,
+	})
+}
+
+// SendBatchTo sends the messages of buffs to addr in order and returns how
+// many were sent. Equal sized messages are written together with UDP
+// segmentation offload where the platform supports it.
+func (n *Node) SendBatchTo(buffs [][]byte, addr uint16) (int, error) {
+	if n == nil || !n.open.isOpen() {
+		return 0, ErrClosed
+	}
+	return n.sendMessages(buffs, addr)
+}
+
+// Listen binds a logical channel identified by port.
+func (n *Node) Listen(port uint16) (*Channel, error) {
+	if n == nil || !n.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return n.ports.bind(&n.Conn, port, nil)
+}
+
+// OpenStream opens a reliable stream to the peer with virtual address addr.
+func (n *Node) OpenStream(addr uint16) (*Stream, error) {
+	if n == nil || !n.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return n.streams().open(addr)
+}
+
+// AcceptStream waits for a stream opened by any peer.
+func (n *Node) AcceptStream() (*Stream, error) {
+	if n == nil || !n.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return n.streams().acceptStream()
+}
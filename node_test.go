@@ -0,0 +1,165 @@
+package sudp
+
+import (
+	"crypto/ecdsa"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMesh starts two nodes with virtual addresses 1 and 2, each one a static
+// peer of the other.
+func newMesh(t *testing.T, opts *NodeOpts) (*Node, *Node) {
+	t.Helper()
+	var (
+		keys   [2]*ecdsa.PrivateKey
+		naddrs [2]*net.UDPAddr
+	)
+	for i := range keys {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		// Reserve a free port, the node binds it again
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		naddrs[i] = conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+	}
+	hmkey := []byte("test hmac key")
+	var nodes [2]*Node
+	for i := range nodes {
+		other := 1 - i
+		n, err := NewNode(&LocalAddr{VirtualAddress: uint16(i + 1), PrivateKey: keys[i], NetworkAddress: naddrs[i]},
+			[]*RemoteAddr{{VirtualAddress: uint16(other + 1), PublicKey: &keys[other].PublicKey,
+				SharedHmacKey: hmkey, NetworkAddress: naddrs[other]}}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(n.Close)
+		nodes[i] = n
+	}
+	return nodes[0], nodes[1]
+}
+
+// nodeReady waits until the session of n with vaddr can send and returns it.
+// The answering node has a pending epoch until the first packet in it.
+func nodeReady(t *testing.T, n *Node, vaddr uint16) PeerInfo {
+	t.Helper()
+	var info PeerInfo
+	waitFor(t, "the node session", func() bool {
+		info, _, _ = n.Peer(vaddr)
+		return info.Ready && info.Epoch != -1
+	})
+	return info
+}
+
+// exchange sends a message each way between the nodes.
+func exchange(t *testing.T, n1, n2 *Node, msg string) {
+	t.Helper()
+	for _, pair := range [][2]*Node{{n1, n2}, {n2, n1}} {
+		if err := pair[0].SendTo([]byte(msg), pair[1].vaddr); err != nil {
+			t.Fatal(err)
+		}
+		b, from, err := pair[1].RecvFrom()
+		if err != nil || string(b) != msg || from != pair[0].vaddr {
+			t.Fatalf("node %d: RecvFrom = %q, %d, %v", pair[1].vaddr, b, from, err)
+		}
+	}
+}
+
+// hsInit returns the handshakes initiated by n with vaddr.
+func hsInit(t *testing.T, n *Node, vaddr uint16) (init uint64) {
+	t.Helper()
+	if err := n.call(func() { init = n.peerMap[vaddr].stats.hsInit }); err != nil {
+		t.Fatal(err)
+	}
+	return init
+}
+
+// Two static peers connect on their own and exchange data both ways.
+func TestNodeHandshake(t *testing.T) {
+	n1, n2 := newMesh(t, &NodeOpts{KeepAliveInterval: 20 * time.Millisecond, HandshakeRetry: 100 * time.Millisecond})
+	nodeReady(t, n1, 2)
+	nodeReady(t, n2, 1)
+	exchange(t, n1, n2, "hello")
+	i1, _, _ := n1.Peer(2)
+	i2, _, _ := n2.Peer(1)
+	if i1.Epoch != i2.Epoch {
+		t.Fatalf("epochs %d and %d", i1.Epoch, i2.Epoch)
+	}
+}
+
+// Handshakes started at once by both nodes end in the session of the lowest
+// virtual address.
+func TestNodeCollision(t *testing.T) {
+	// The control ticker never runs, the handshakes are started by the test
+	n1, n2 := newMesh(t, &NodeOpts{KeepAliveInterval: time.Hour, IdleTimeout: 2 * time.Hour})
+	const e1, e2 = 100, 200
+	var entered, started sync.WaitGroup
+	entered.Add(2)
+	started.Add(2)
+	errc := make(chan error, 2)
+	for _, s := range []struct {
+		n     *Node
+		vaddr uint16
+		epoch int
+	}{{n1, 2, e1}, {n2, 1, e2}} {
+		go func() {
+			errc <- s.n.call(func() {
+				// Both loops hold until both handshakes are on the wire
+				entered.Done()
+				entered.Wait()
+				s.n.peerMap[s.vaddr].initiate(&s.n.Conn, s.epoch)
+				started.Done()
+				started.Wait()
+			})
+		}()
+	}
+	for range 2 {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodeReady(t, n1, 2)
+	nodeReady(t, n2, 1)
+	exchange(t, n1, n2, "after collision")
+	i1, _, _ := n1.Peer(2)
+	i2, _, _ := n2.Peer(1)
+	if i1.Epoch != e1 || i2.Epoch != e1 {
+		t.Fatalf("epochs %d and %d, want %d", i1.Epoch, i2.Epoch, e1)
+	}
+}
+
+// Only the node with the lowest virtual address rotates the epochs.
+func TestNodeRotation(t *testing.T) {
+	opts := &NodeOpts{
+		KeepAliveInterval: 20 * time.Millisecond,
+		HandshakeRetry:    100 * time.Millisecond,
+		EpochLifetime:     150 * time.Millisecond,
+	}
+	n1, n2 := newMesh(t, opts)
+	first := nodeReady(t, n1, 2).Epoch
+	nodeReady(t, n2, 1)
+	init2 := hsInit(t, n2, 1)
+
+	time.Sleep(4 * opts.EpochLifetime)
+	i1, i2 := nodeReady(t, n1, 2), nodeReady(t, n2, 1)
+	if i1.Epoch <= first {
+		t.Fatalf("epoch %d, want a rotation from %d", i1.Epoch, first)
+	}
+	if i2.Epoch != i1.Epoch && i2.PendingEpoch != i1.Epoch && i1.PendingEpoch != i2.Epoch {
+		t.Fatalf("epochs %d and %d", i1.Epoch, i2.Epoch)
+	}
+	if got := hsInit(t, n2, 1); got != init2 {
+		t.Fatalf("node 2 initiated %d handshakes after the session was up", got-init2)
+	}
+	if hsInit(t, n1, 2) < 2 {
+		t.Fatal("node 1 did not rotate")
+	}
+	exchange(t, n1, n2, "rotated")
+}
@@ -1,36 +1,77 @@
 package sudp
 
 import (
+	"crypto/cipher"
 	"crypto/ecdsa"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 type peer struct {
 	epochs    epochs
 	pubkey    *ecdsa.PublicKey
-	hmackey   []byte
+	hmackey   *hmacKey
+	acl       *ACL
 	naddr     *net.UDPAddr // Net Address
 	vaddr     uint16       // Protocol virtual address
 	ttlm      time.Time    // Time to last message
 	tsync     *timeSync
 	ready     bool
 	handshake *handshakestate
+	hsent     time.Time // Last server handshake sent, for the RTT sample of its EpochAck
+	rtt       rttStats
+	stats     counters
+	sent      txcounters              // Packets sent, counted from any goroutine
+	tx        atomic.Pointer[sendKey] // Session used by the senders, nil if not ready
 	//hndshk  bool
 	//resend  *pkthandshakeraw
 	//hsSent  time.Time
 }
 
-func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, toUser chan *message, conn *net.UDPConn) error {
+func newPeer(addr *RemoteAddr) *peer {
+	p := &peer{
+		vaddr:   addr.VirtualAddress,
+		pubkey:  addr.PublicKey,
+		hmackey: newHmacKey(addr.SharedHmacKey),
+		acl:     addr.ACL,
+	}
+	p.epochs.init()
+	return p
+}
+
+// handlePacket processes a packet of the peer and releases it, unless its data
+// is handed to the connection.
+func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, conn *Conn) (err error) {
+	p.stats.rxPackets++
+	p.stats.rxBytes += uint64(hdrsz + pkt.size)
+	current := p.epochs.cEpoch
+	delivered := false
+	defer func() {
+		if err != nil && (hdr.kind == typeClientHandshake || hdr.kind == typeServerHandshake) {
+			p.stats.hsFail++
+		}
+		if current != -1 && p.epochs.cEpoch != -1 && p.epochs.cEpoch != current {
+			p.stats.rotations++
+		}
+		p.publish()
+		if !delivered {
+			pkt.release()
+		}
+	}()
+	body := pkt.head(int(hdr.len))
+	if body == nil {
+		return newDrop(DropMalformed, "invalid length - message drop", nil)
+	}
 	switch hdr.kind {
 	case typeClientHandshake:
-		hs, e := handshakeLoad(pkt.head(int(hdr.len)), p.pubkey)
-		if e != nil || hdr.hmac != hs.hmac {
-			if e == nil {
-				e = fmt.Errorf("invalid hmac")
-			}
-			return newError("at client handshake", e)
+		hs, e := handshakeLoad(body, p.pubkey)
+		if e != nil {
+			return newDrop(DropBadSignature, "at client handshake", e)
+		}
+		if hdr.hmac != hs.hmac {
+			return newDrop(DropBadHMAC, "at client handshake", fmt.Errorf("invalid hmac"))
 		}
 		key, e := p.epochs.new(int(hdr.epoch))
 		if e != nil {
@@ -41,7 +82,7 @@ func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, t
 		}
 
 		p.ttlm = time.Now()
-		if pkt.addr.String() != p.naddr.String() {
+		if !sameAddr(pkt.addr, p.naddr) {
 			p.naddr = pkt.addr
 		}
 
@@ -58,21 +99,26 @@ func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, t
 		}
 		copy(sh.pubkey[:], key.public())
 		sh.hmac = h.hmac
-		if e := sh.dump(packet.tail(handshakesz), private); e != nil {
+		if e := sh.dump(packet.tail(handshakesz), conn.private); e != nil {
 			return newError("serializing server handshake", e)
 		}
 		p.ready = true
-		return packet.pktSend(conn)
+		p.hsent = time.Now()
+		p.stats.hsDone++
+		return p.send(packet, conn.conn)
 
 	case typeServerHandshake:
-		sh, e := handshakeLoad(pkt.head(int(hdr.len)), p.pubkey)
-		if e != nil || hdr.hmac != sh.hmac {
-			return newError("at server handshake", e)
+		sh, e := handshakeLoad(body, p.pubkey)
+		if e != nil {
+			return newDrop(DropBadSignature, "at server handshake", e)
+		}
+		if hdr.hmac != sh.hmac {
+			return newDrop(DropBadHMAC, "at server handshake", fmt.Errorf("invalid hmac"))
 		}
 
 		pending, key := p.epochs.pending()
 		if pending != int(hdr.epoch) {
-			return newError("invalid epoch", nil)
+			return newDrop(DropInvalidEpoch, "invalid epoch", nil)
 		}
 		if e := key.ecdh(sh.pubkey[:]); e != nil {
 			return newError("shared secret", e)
@@ -85,6 +131,7 @@ func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, t
 
 		p.ttlm = time.Now()
 		p.ready = true
+		p.stats.hsDone++
 		/*if p.hndshk == true {
 			p.hndshk = false
 			p.hsSent = time.Time{}
@@ -92,27 +139,26 @@ func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, t
 		}
 		*/
 		if p.handshake != nil {
+			// Retransmitted handshakes give ambiguous samples
+			if p.handshake.tries == 0 {
+				p.sample(time.Since(p.handshake.senttime))
+			}
+			p.stats.hsLatency.observe(time.Since(p.handshake.started))
 			p.handshake = nil
 		}
-		packet := allocPktbuff()
-		packet.addr = p.naddr
-		h := newHdr(typeCtrlMessage, hdr.epoch, hdr.dst, hdr.src)
-		h.len = ctrlmessagesz
-		if e := h.dump(packet.tail(hdrsz), p.hmackey); e != nil {
-			return newError("serializing hdr", e)
-		}
-		ctrl := ctrlmessage{}
-		ctrl.hmac = h.hmac
-		ctrl.set(EpochAck)
-		if e := ctrl.dump(packet.tail(ctrlmessagesz), private); e != nil {
-			return newError("serializing ctrl message", e)
-		}
-		return packet.pktSend(conn)
+		return p.sendCtrl(conn, hdr.epoch, EpochAck, 0)
 
 	case typeCtrlMessage:
-		c, e := ctrlmessageLoad(pkt.head(int(hdr.len)), p.pubkey)
-		if e != nil || hdr.hmac != c.hmac {
-			return newError("at ctrl message", e)
+		c, e := ctrlmessageLoad(body, p.pubkey)
+		if e != nil {
+			return newDrop(DropBadSignature, "at ctrl message", e)
+		}
+		if hdr.hmac != c.hmac {
+			return newDrop(DropBadHMAC, "at ctrl message", fmt.Errorf("invalid hmac"))
+		}
+		// A Close of a previous session, maybe replayed, must not end this one
+		if c.isSet(Close) && !p.epochs.isCurrent(int(hdr.epoch)) && !p.epochs.isPending(int(hdr.epoch)) {
+			return newDrop(DropInvalidEpoch, fmt.Sprintf("close in epoch %d - message drop", hdr.epoch), nil)
 		}
 		if (c.isSet(EpochAck) && p.epochs.isPending(int(hdr.epoch))) || p.epochs.isPending(int(hdr.epoch)) {
 			pending := int(hdr.epoch)
@@ -121,27 +167,34 @@ func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, t
 				return newError("promoting new epoch", e)
 			}
 		}
+		if c.isSet(EpochAck) && !p.hsent.IsZero() {
+			p.sample(time.Since(p.hsent))
+			p.stats.hsLatency.observe(time.Since(p.hsent))
+			p.hsent = time.Time{}
+		}
 		p.ttlm = time.Now()
-		if pkt.addr.String() != p.naddr.String() {
+		if !sameAddr(pkt.addr, p.naddr) {
 			p.naddr = pkt.addr
 		}
-		if c.isSet(KeepAlive) {
-			packet := allocPktbuff()
-			packet.addr = p.naddr
-			header := newHdr(typeCtrlMessage, hdr.epoch, hdr.dst, hdr.src)
-			header.len = ctrlmessagesz
-			if e := header.dump(packet.tail(hdrsz), p.hmackey); e != nil {
-				return newError("serializing hdr", e)
-			}
-			ctrl := ctrlmessage{}
-			ctrl.hmac = header.hmac
-			ctrl.set(KeepAliveAck)
-			if e := ctrl.dump(packet.tail(ctrlmessagesz), private); e != nil {
-				return newError("serializing ctrl message", e)
+		if conn.onCtrl != nil {
+			if e := conn.onCtrl(p, c); e != nil {
+				return e
 			}
-			return packet.pktSend(conn)
 		}
-	case typeData:
+		if c.isSet(RTTAck) {
+			p.sample(time.Since(time.UnixMicro(int64(c.data))))
+		}
+		var reply uint32
+		if c.isSet(KeepAlive) {
+			reply |= KeepAliveAck
+		}
+		if c.isSet(RTT) {
+			reply |= RTTAck
+		}
+		if reply != 0 {
+			return p.sendCtrl(conn, hdr.epoch, reply, c.data)
+		}
+	case typeData, typeStream:
 		var (
 			epoch int
 			key   *dhss
@@ -153,47 +206,251 @@ func (p *peer) handlePacket(hdr *hdr, pkt *pktbuff, private *ecdsa.PrivateKey, t
 			_, key = p.epochs.current()
 		} else if p.epochs.isPending(epoch) {
 			if e := p.epochs.promote(int(hdr.epoch)); e != nil {
-				return fmt.Errorf("invalid epoch: %v, header: %d", e, int(hdr.epoch))
+				return newDrop(DropInvalidEpoch, fmt.Sprintf("invalid epoch %d", hdr.epoch), e)
 			}
 			_, key = p.epochs.current()
 		} else if p.epochs.isPrev(epoch) {
 			_, key = p.epochs.prev()
 		} else {
-			return fmt.Errorf("invalid epoch - drop")
+			return newDrop(DropInvalidEpoch, "invalid epoch - drop", nil)
+		}
+		data, e := loadData(body, key)
+		if e != nil {
+			return newDrop(DropDecrypt, "at data reception", e)
 		}
-		data, e := loadData(pkt.head(int(hdr.len)), key)
-		if e != nil || data.hmac != hdr.hmac {
-			return newError("at data reception", e)
+		if data.hmac != hdr.hmac {
+			return newDrop(DropBadHMAC, "at data reception", fmt.Errorf("invalid hmac"))
 		}
 		p.ttlm = time.Now()
-		if pkt.addr.String() != p.naddr.String() {
+		if !sameAddr(pkt.addr, p.naddr) {
 			p.naddr = pkt.addr
 		}
-		toUser <- &message{
+		pkt.msg = message{
+			kind: hdr.kind,
+			port: data.port,
 			buff: data.buff,
 			addr: hdr.src,
+			dst:  hdr.dst,
+			pkt:  pkt,
 		}
+		delivered = true
+		conn.onData(&pkt.msg)
 	}
 	return nil
 }
 
-func (p *peer) sendDataPacket(src uint16, buff []byte, conn *net.UDPConn) error {
-	epoch, key := p.epochs.current()
-	if epoch == -1 || key == nil {
-		return newError("invalid epoch", nil)
+// sendCtrl sends a signed control message with the given flags to the peer.
+func (p *peer) sendCtrl(conn *Conn, epoch uint32, flags uint32, data uint64) error {
+	return p.sendCtrlTo(conn, p.naddr, p.hmackey, epoch, flags, data)
+}
+
+// sendCtrlKey sends a control message with the send key of the peer, from a
+// goroutine that does not own it.
+func (p *peer) sendCtrlKey(conn *Conn, k *sendKey, flags uint32, data uint64) error {
+	return p.sendCtrlTo(conn, k.naddr, k.hmackey, k.epoch, flags, data)
+}
+
+func (p *peer) sendCtrlTo(conn *Conn, naddr *net.UDPAddr, hmackey *hmacKey, epoch uint32, flags uint32, data uint64) error {
+	packet := allocPktbuff()
+	packet.addr = naddr
+	header := newHdr(typeCtrlMessage, epoch, conn.vaddr, p.vaddr)
+	header.len = ctrlmessagesz
+	if e := header.dump(packet.tail(hdrsz), hmackey); e != nil {
+		return newError("serializing hdr", e)
+	}
+	ctrl := ctrlmessage{}
+	ctrl.hmac = header.hmac
+	ctrl.data = data
+	ctrl.set(flags)
+	if e := ctrl.dump(packet.tail(ctrlmessagesz), conn.private); e != nil {
+		return newError("serializing ctrl message", e)
 	}
+	return p.send(packet, conn.conn)
+}
+
+func (p *peer) sample(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	p.rtt.update(rtt)
+	p.stats.rtt.observe(rtt)
+}
+
+// probe sends the control flags with an RTT request, the answer updates the
+// RTT estimation of the peer.
+func (p *peer) probe(conn *Conn, epoch uint32, flags uint32) error {
+	return p.sendCtrl(conn, epoch, flags|RTT, uint64(time.Now().UnixMicro()))
+}
+
+// initiate starts a handshake for a new epoch, as client of the session.
+func (p *peer) initiate(conn *Conn, epoch int) error {
+	key, err := p.epochs.new(epoch)
+	if err != nil {
+		return err
+	}
+	header := newHdr(typeClientHandshake, uint32(epoch), conn.vaddr, p.vaddr)
+	header.len = handshakesz
 	packet := allocPktbuff()
 	packet.addr = p.naddr
-	hdr := newHdr(typeData, uint32(epoch), src, p.vaddr)
-	hdr.len = uint16(len(buff) + dataOverload)
-	if e := hdr.dump(packet.tail(hdrsz), p.hmackey); e != nil {
-		return newError("hdr dump", e)
+	if err = header.dump(packet.tail(hdrsz), p.hmackey); err != nil {
+		return err
+	}
+	handshake := handshake{
+		hmac: header.hmac,
+	}
+	copy(handshake.pubkey[:], key.public())
+	if err = handshake.dump(packet.tail(handshakesz), conn.private); err != nil {
+		return err
+	}
+	p.stats.hsInit++
+	p.handshake = &handshakestate{
+		tries:    0,
+		started:  time.Now(),
+		senttime: time.Now(),
+		hdr:      header,
+		msg:      handshake,
+	}
+	return p.send(packet, conn.conn)
+}
+
+// inTime verifies the timestamp of a header, the first one synchronizes the
+// clock offset with the peer.
+func (p *peer) inTime(hdr *hdr) error {
+	var e error
+	if p.tsync == nil {
+		if p.tsync, e = newTimeSync(hdr.time); e != nil {
+			return newDrop(DropOutOfTime, "not in time, peer time not well configured - message drop", e)
+		}
+	} else if !p.tsync.inTime(hdr.time) {
+		return newDrop(DropOutOfTime, fmt.Sprintf("not in time %d, out of sync - message drop", hdr.time), nil)
+	}
+	return nil
+}
+
+// sendKey is the part of a session needed to send data. The loop replaces it
+// whenever the session changes, so senders can encrypt and write on their own
+// goroutine without locks. When the keys of a session are destroyed it is
+// withdrawn first, see wipe.
+type sendKey struct {
+	epoch   uint32
+	aead    cipher.AEAD
+	naddr   *net.UDPAddr
+	hmackey *hmacKey
+}
+
+// wipe destroys the keys of every epoch of p. The send key is withdrawn in the
+// same step, so senders stop using the cipher before its keys are cleared. It
+// is called from the loop only.
+func (p *peer) wipe() {
+	p.tx.Store(nil)
+	p.epochs.wipe()
+}
+
+// publish updates the send key after a change of the session, it is called
+// from the loop only.
+func (p *peer) publish() {
+	epoch, key := p.epochs.current()
+	if !p.ready || key == nil || key.aead == nil || p.naddr == nil {
+		if p.tx.Load() != nil {
+			p.tx.Store(nil)
+		}
+		return
+	}
+	if k := p.tx.Load(); k != nil && k.aead == key.aead && k.naddr == p.naddr && k.hmackey == p.hmackey {
+		return
+	}
+	p.tx.Store(&sendKey{
+		epoch:   uint32(epoch),
+		aead:    key.aead,
+		naddr:   p.naddr,
+		hmackey: p.hmackey,
+	})
+}
+
+// sendDataPacket encrypts msg with the current epoch of the peer from the
+// loop. The header destination is msg.addr, which is not the peer itself when
+// relaying.
+func (p *peer) sendDataPacket(src uint16, msg *message, conn *net.UDPConn) error {
+	p.publish()
+	k := p.tx.Load()
+	if k == nil {
+		return ErrNotReady
+	}
+	return p.sendData(k, src, msg, conn)
+}
+
+// sendData encrypts msg with k and writes it to the peer, it may be called
+// from any goroutine.
+func (p *peer) sendData(k *sendKey, src uint16, msg *message, conn *net.UDPConn) error {
+	packet, e := seal(k, src, msg)
+	if e != nil {
+		return e
+	}
+	return p.send(packet, conn)
+}
+
+// sendDataBatch encrypts msgs with the current epoch of the peer and writes
+// them with as few system calls as possible, from the loop.
+func (p *peer) sendDataBatch(src uint16, msgs []*message, w *pktWriter) error {
+	p.publish()
+	k := p.tx.Load()
+	if k == nil {
+		return ErrNotReady
+	}
+	_, e := p.sendBatch(k, src, msgs, w)
+	return e
+}
+
+// sendBatch encrypts msgs with k and writes them in order, it returns how many
+// were sent and may be called from any goroutine.
+func (p *peer) sendBatch(k *sendKey, src uint16, msgs []*message, w *pktWriter) (int, error) {
+	packets := make([]*pktbuff, 0, len(msgs))
+	defer func() {
+		for _, packet := range packets {
+			packet.release()
+		}
+	}()
+	for _, msg := range msgs {
+		packet, e := seal(k, src, msg)
+		if e != nil {
+			return 0, e
+		}
+		packets = append(packets, packet)
+	}
+	n, e := w.send(packets)
+	for _, packet := range packets[:n] {
+		p.sent.count(packet.size)
+	}
+	return n, e
+}
+
+// seal builds the data packet of msg with the send key k.
+func seal(k *sendKey, src uint16, msg *message) (*pktbuff, error) {
+	packet := allocPktbuff()
+	packet.addr = k.naddr
+	hdr := newHdr(msg.kind, k.epoch, src, msg.addr)
+	hdr.len = uint16(len(msg.buff) + dataOverload)
+	if e := hdr.dump(packet.tail(hdrsz), k.hmackey); e != nil {
+		packet.release()
+		return nil, newError("hdr dump", e)
 	}
 	data := data{}
 	data.hmac = hdr.hmac
-	data.buff = buff
-	if e := data.dump(key, packet.tail(int(hdr.len))); e != nil {
-		return newError("data dump", e)
+	data.port = msg.port
+	data.buff = msg.buff
+	if e := data.dump(k.aead, packet.tail(int(hdr.len))); e != nil {
+		packet.release()
+		return nil, newError("data dump", e)
 	}
-	return packet.pktSend(conn)
+	return packet, nil
+}
+
+// send writes packet to the peer, counts it and releases it.
+func (p *peer) send(packet *pktbuff, conn *net.UDPConn) error {
+	defer packet.release()
+	if e := packet.pktSend(conn); e != nil {
+		return e
+	}
+	p.sent.count(packet.size)
+	return nil
 }
@@ -0,0 +1,270 @@
+package sudp
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// PeerInfo is a snapshot of the session with a peer.
+type PeerInfo struct {
+	VirtualAddress uint16
+	NetworkAddress *net.UDPAddr
+	Ready          bool
+	Epoch          int           // Current epoch, -1 if none
+	PendingEpoch   int           // Epoch being negotiated, -1 if none
+	PrevEpoch      int           // Previous epoch still accepted, -1 if none
+	LastActivity   time.Time     // Last message received
+	EpochStarted   time.Time     // Promotion of the current epoch
+	RTT            time.Duration // Smoothed round trip time, 0 until measured
+	RTTVar         time.Duration // Round trip time variation
+	MinRTT         time.Duration
+	ClockOffset    time.Duration // Local clock minus the peer clock, including the network delay
+	RxPackets      uint64
+	RxBytes        uint64
+	TxPackets      uint64
+	TxBytes        uint64
+}
+
+func (p *peer) info() PeerInfo {
+	info := PeerInfo{
+		VirtualAddress: p.vaddr,
+		Ready:          p.ready,
+		Epoch:          p.epochs.cEpoch,
+		PendingEpoch:   p.epochs.nEpoch,
+		PrevEpoch:      p.epochs.pEpoch,
+		LastActivity:   p.ttlm,
+		EpochStarted:   p.epochs.ctime,
+		RTT:            p.rtt.srtt,
+		RTTVar:         p.rtt.rttvar,
+		MinRTT:         p.rtt.min,
+		RxPackets:      p.stats.rxPackets,
+		RxBytes:        p.stats.rxBytes,
+		TxPackets:      p.sent.packets.Load(),
+		TxBytes:        p.sent.bytes.Load(),
+	}
+	if p.naddr != nil {
+		a := *p.naddr
+		info.NetworkAddress = &a
+	}
+	if p.tsync != nil {
+		info.ClockOffset = p.tsync.offset
+	}
+	return info
+}
+
+// Peers returns a snapshot of every configured peer, ordered by virtual address.
+func (s *ServerConn) Peers() ([]PeerInfo, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	var peers []PeerInfo
+	e := s.callAll(func(w *worker) {
+		for _, p := range w.peerMap {
+			peers = append(peers, p.info())
+		}
+	})
+	slices.SortFunc(peers, func(a, b PeerInfo) int { return int(a.VirtualAddress) - int(b.VirtualAddress) })
+	return peers, e
+}
+
+// Peer returns a snapshot of the peer with virtual address vaddr, false if it
+// is not configured.
+func (s *ServerConn) Peer(vaddr uint16) (PeerInfo, bool, error) {
+	var (
+		info PeerInfo
+		ok   bool
+	)
+	if s == nil || !s.open.isOpen() {
+		return info, false, ErrClosed
+	}
+	e := s.callPeer(vaddr, func(w *worker) {
+		var p *peer
+		if p, ok = w.peerMap[vaddr]; ok {
+			info = p.info()
+		}
+	})
+	return info, ok, e
+}
+
+// Info returns a snapshot of the session with the server.
+func (c *ClientConn) Info() (PeerInfo, error) {
+	if c == nil || !c.open.isOpen() {
+		return PeerInfo{}, ErrClosed
+	}
+	var info PeerInfo
+	e := c.call(func() { info = c.server.info() })
+	return info, e
+}
+
+// Peer returns a snapshot of the session with the peer with virtual address
+// vaddr, false if it is not configured.
+func (n *Node) Peer(vaddr uint16) (PeerInfo, bool, error) {
+	var (
+		info PeerInfo
+		ok   bool
+	)
+	if n == nil || !n.open.isOpen() {
+		return info, false, ErrClosed
+	}
+	e := n.call(func() {
+		var p *peer
+		if p, ok = n.peerMap[vaddr]; ok {
+			info = p.info()
+		}
+	})
+	return info, ok, e
+}
+
+// AddPeer registers a new peer on a running server, its session starts with
+// its first handshake.
+func (s *ServerConn) AddPeer(raddr *RemoteAddr) error {
+	if s == nil || !s.open.isOpen() {
+		return ErrClosed
+	}
+	if raddr == nil || raddr.PublicKey == nil {
+		return fmt.Errorf("public key not present")
+	}
+	var e error
+	if err := s.callPeer(raddr.VirtualAddress, func(w *worker) {
+		if _, ok := w.peerMap[raddr.VirtualAddress]; ok || raddr.VirtualAddress == s.vaddr {
+			e = fmt.Errorf("virtual address %d already in use", raddr.VirtualAddress)
+			return
+		}
+		p := newPeer(raddr)
+		w.peerMap[raddr.VirtualAddress] = p
+		s.addSender(p)
+	}); err != nil {
+		return err
+	}
+	return e
+}
+
+// UpdatePeer replaces the keys and the ACL of a peer. The session of the peer
+// is closed only when its keys change.
+func (s *ServerConn) UpdatePeer(raddr *RemoteAddr) error {
+	if s == nil || !s.open.isOpen() {
+		return ErrClosed
+	}
+	if raddr == nil || raddr.PublicKey == nil {
+		return fmt.Errorf("public key not present")
+	}
+	var e error
+	if err := s.callPeer(raddr.VirtualAddress, func(w *worker) {
+		p, ok := w.peerMap[raddr.VirtualAddress]
+		if !ok {
+			e = fmt.Errorf("%w %d", ErrUnknownPeer, raddr.VirtualAddress)
+			return
+		}
+		if !p.pubkey.Equal(raddr.PublicKey) || !p.hmackey.equal(raddr.SharedHmacKey) {
+			s.drop(p, CloseRekeyed)
+			p.pubkey = raddr.PublicKey
+			p.hmackey = newHmacKey(raddr.SharedHmacKey)
+		}
+		p.acl = raddr.ACL
+	}); err != nil {
+		return err
+	}
+	return e
+}
+
+// RemovePeer closes the session of a peer and forgets it.
+func (s *ServerConn) RemovePeer(vaddr uint16) error {
+	if s == nil || !s.open.isOpen() {
+		return ErrClosed
+	}
+	var e error
+	if err := s.callPeer(vaddr, func(w *worker) {
+		p, ok := w.peerMap[vaddr]
+		if !ok {
+			e = fmt.Errorf("%w %d", ErrUnknownPeer, vaddr)
+			return
+		}
+		s.drop(p, CloseRemoved)
+		s.forget(w, p)
+	}); err != nil {
+		return err
+	}
+	return e
+}
+
+func (s *ServerConn) reset(p *peer) {
+	p.wipe()
+	p.naddr = nil
+	p.handshake = nil
+	p.ready = false
+	p.tsync = nil
+	p.ttlm = time.Time{}
+	p.publish()
+	s.resetStreams(func(addr uint16) bool { return addr == p.vaddr })
+}
+
+// drop closes the session with p, notifying the peer.
+func (s *ServerConn) drop(p *peer, reason CloseReason) {
+	ready, naddr := p.ready, p.naddr
+	p.notify(&s.Conn, reason)
+	s.reset(p)
+	if ready {
+		s.emitDown(p, naddr, reason, false)
+	}
+}
+
+// forget removes p from its worker, its counters are kept in the totals of the
+// server.
+func (s *ServerConn) forget(w *worker, p *peer) {
+	pc := p.counters()
+	s.slock.Lock()
+	s.stats.add(&pc)
+	s.slock.Unlock()
+	delete(w.peerMap, p.vaddr)
+	s.removeSender(p.vaddr)
+}
+
+// sync replaces the peers of the server with raddrs, in a single step for each
+// worker. Sessions are closed only for removed peers and peers with new keys.
+func (s *ServerConn) sync(raddrs []*RemoteAddr) (added, rekeyed, removed int, err error) {
+	want := make(map[uint16]*RemoteAddr)
+	for _, raddr := range raddrs {
+		if raddr.PublicKey == nil {
+			return 0, 0, 0, fmt.Errorf("peer %d: public key not present", raddr.VirtualAddress)
+		}
+		if raddr.VirtualAddress == s.vaddr {
+			return 0, 0, 0, fmt.Errorf("peer %d: virtual address of the server", raddr.VirtualAddress)
+		}
+		if _, ok := want[raddr.VirtualAddress]; ok {
+			return 0, 0, 0, fmt.Errorf("peer %d: duplicated virtual address", raddr.VirtualAddress)
+		}
+		want[raddr.VirtualAddress] = raddr
+	}
+	err = s.callAll(func(w *worker) {
+		for vaddr, p := range w.peerMap {
+			if _, ok := want[vaddr]; !ok {
+				s.drop(p, CloseRemoved)
+				s.forget(w, p)
+				removed++
+			}
+		}
+		for vaddr, raddr := range want {
+			if s.worker(vaddr) != w {
+				continue
+			}
+			p, ok := w.peerMap[vaddr]
+			if !ok {
+				p := newPeer(raddr)
+				w.peerMap[vaddr] = p
+				s.addSender(p)
+				added++
+				continue
+			}
+			if !p.pubkey.Equal(raddr.PublicKey) || !p.hmackey.equal(raddr.SharedHmacKey) {
+				s.drop(p, CloseRekeyed)
+				p.pubkey = raddr.PublicKey
+				p.hmackey = newHmacKey(raddr.SharedHmacKey)
+				rekeyed++
+			}
+			p.acl = raddr.ACL
+		}
+	})
+	return
+}
@@ -0,0 +1,167 @@
+package sudp
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectTo connects vaddr with key to srv, failing fast when the server does
+// not answer.
+func connectTo(t *testing.T, srv *ServerConn, vaddr uint16, key *ecdsa.PrivateKey) (*ClientConn, error) {
+	t.Helper()
+	cli, err := Connect(&LocalAddr{VirtualAddress: vaddr, PrivateKey: key},
+		&RemoteAddr{PublicKey: &srv.private.PublicKey, SharedHmacKey: []byte("test hmac key"),
+			NetworkAddress: srv.conns[0].LocalAddr().(*net.UDPAddr)},
+		&ClientOpts{Tries: 2, KeepAliveInterval: 20 * time.Millisecond, HandshakeRetry: 50 * time.Millisecond})
+	if err == nil {
+		t.Cleanup(func() { cli.Close() })
+	}
+	return cli, err
+}
+
+// A peer added to a running server can connect at once.
+func TestAddPeer(t *testing.T) {
+	srv, _, _ := newStar(t, 1, nil, nil)
+	key, _ := GenerateKey()
+	raddr := &RemoteAddr{VirtualAddress: 5, PublicKey: &key.PublicKey, SharedHmacKey: []byte("test hmac key")}
+	if _, err := connectTo(t, srv, 5, key); err == nil {
+		t.Fatal("unknown peer connected")
+	}
+	if err := srv.AddPeer(raddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddPeer(raddr); err == nil {
+		t.Fatal("peer added twice")
+	}
+	cli, err := connectTo(t, srv, 5, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Send([]byte("added")); err != nil {
+		t.Fatal(err)
+	}
+	b, from, err := srv.RecvFrom()
+	if err != nil || string(b) != "added" || from != 5 {
+		t.Fatalf("RecvFrom = %q, %d, %v", b, from, err)
+	}
+}
+
+// New keys close the session of a peer, which can only connect again with them.
+func TestUpdatePeerRekey(t *testing.T) {
+	srv, clients, remotes := newStar(t, 1, nil, nil)
+	old := clients[0]
+	if err := old.Send([]byte("old key")); err != nil {
+		t.Fatal(err)
+	}
+	recvAll(t, srv, 1)
+	oldKey := old.private
+	key, _ := GenerateKey()
+	if err := srv.UpdatePeer(&RemoteAddr{VirtualAddress: 1, PublicKey: &key.PublicKey, SharedHmacKey: remotes[0].SharedHmacKey}); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CloseError
+	if err := old.GetErrors(); !errors.As(err, &ce) || ce.Reason != CloseRekeyed {
+		t.Fatalf("GetErrors = %v, want a %v close", err, CloseRekeyed)
+	}
+	var he *HandshakeError
+	if _, err := connectTo(t, srv, 1, oldKey); !errors.As(err, &he) || !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Connect with the old key = %v, want a handshake timeout", err)
+	}
+	if peerDrops(t, srv, 1, DropBadSignature) == 0 {
+		t.Fatal("handshake with the old key not counted as a bad signature")
+	}
+	cli, err := connectTo(t, srv, 1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Send([]byte("new key")); err != nil {
+		t.Fatal(err)
+	}
+	if b := recvAll(t, srv, 1); string(b[0]) != "new key" {
+		t.Fatalf("RecvFrom = %q", b[0])
+	}
+}
+
+// A removed peer is told so and its connection ends.
+func TestRemovePeer(t *testing.T) {
+	srv, clients, _ := newStar(t, 1, nil, nil)
+	cli := clients[0]
+	if err := cli.Send([]byte("ready")); err != nil {
+		t.Fatal(err)
+	}
+	recvAll(t, srv, 1)
+	if err := srv.RemovePeer(1); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CloseError
+	if err := cli.GetErrors(); !errors.As(err, &ce) || ce.Reason != CloseRemoved {
+		t.Fatalf("GetErrors = %v, want a %v close", err, CloseRemoved)
+	}
+	if err := cli.Send([]byte("removed")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Send = %v, want %v", err, ErrClosed)
+	}
+	if _, ok, _ := srv.Peer(1); ok {
+		t.Fatal("removed peer still listed")
+	}
+}
+
+// Peers and Peer report the state and the counters of the sessions.
+func TestPeersSnapshot(t *testing.T) {
+	srv, clients, _ := newStar(t, 2, nil, nil)
+	start := time.Now()
+	const n, size = 3, 100
+	for range n {
+		if err := clients[0].Send(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recvAll(t, srv, n)
+	for range 2 {
+		if err := srv.SendTo(make([]byte, size), 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := clients[0].RecvFrom(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peers, err := srv.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].VirtualAddress != 1 || peers[1].VirtualAddress != 2 {
+		t.Fatalf("Peers = %+v", peers)
+	}
+	info, ok, err := srv.Peer(1)
+	if err != nil || !ok {
+		t.Fatalf("Peer(1) = %v, %v", ok, err)
+	}
+	if !info.Ready || info.Epoch == -1 || info.PendingEpoch != -1 {
+		t.Fatalf("session ready %v in epoch %d, pending %d", info.Ready, info.Epoch, info.PendingEpoch)
+	}
+	if port := clients[0].conn.LocalAddr().(*net.UDPAddr).Port; info.NetworkAddress == nil || info.NetworkAddress.Port != port {
+		t.Fatalf("network address %v, want port %d", info.NetworkAddress, port)
+	}
+	// The handshake and the data of the client, the answer and the data of the server
+	if info.RxPackets < n+1 || info.RxBytes < n*size || info.TxPackets < 3 || info.TxBytes < 2*size {
+		t.Fatalf("counters rx %d/%d tx %d/%d", info.RxPackets, info.RxBytes, info.TxPackets, info.TxBytes)
+	}
+	if info.LastActivity.Before(start) || info.EpochStarted.IsZero() || info.EpochStarted.After(time.Now()) {
+		t.Fatalf("last activity %v, epoch started %v", info.LastActivity, info.EpochStarted)
+	}
+	if info.RxPackets < peers[0].RxPackets {
+		t.Fatalf("counters went back from %d to %d", peers[0].RxPackets, info.RxPackets)
+	}
+
+	// A snapshot is a copy
+	info.NetworkAddress.Port++
+	if again, _, _ := srv.Peer(1); again.NetworkAddress.Port == info.NetworkAddress.Port {
+		t.Fatal("snapshot shares the network address of the session")
+	}
+	if _, ok, err := srv.Peer(99); ok || err != nil {
+		t.Fatalf("Peer(99) = %v, %v", ok, err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 )
 
@@ -11,15 +13,46 @@ type pktbuff struct {
 	addr *net.UDPAddr
 	buff []byte
 	size int
+	mem  []byte  // Whole buffer, buff is advanced by head
+	hdr  hdr     // Header of a received packet
+	msg  message // Data received in the packet, its buffer points into mem
+}
+
+// pktbuffSize is the largest packet sent or received.
+const pktbuffSize = 2048
+
+// MaxMessageSize is the largest message accepted by Send.
+const MaxMessageSize = pktbuffSize - hdrsz - dataOverload
+
+var pktPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, pktbuffSize)
+		return &pktbuff{buff: b, mem: b}
+	},
 }
 
 func allocPktbuff() *pktbuff {
-	pkt := pktbuff{
-		addr: nil,
-		size: 0,
-		buff: make([]byte, 2048),
+	return pktPool.Get().(*pktbuff)
+}
+
+// release returns the packet to the pool, neither the packet nor its message
+// can be used afterwards.
+func (p *pktbuff) release() {
+	p.addr = nil
+	p.buff = p.mem
+	p.size = 0
+	p.msg = message{}
+	pktPool.Put(p)
+}
+
+// loadHdr parses the header of a received packet into the packet itself.
+func (p *pktbuff) loadHdr(b []byte, hmkey *hmacKey) (*hdr, error) {
+	h, e := hdrLoad(b, hmkey)
+	if e != nil {
+		return nil, e
 	}
-	return &pkt
+	p.hdr = h
+	return &p.hdr, nil
 }
 
 func (p *pktbuff) head(n int) []byte {
@@ -45,14 +78,56 @@ func (p *pktbuff) pktSend(conn *net.UDPConn) error {
 	if p.addr == nil {
 		return fmt.Errorf("invalid destination")
 	}
-	_, e := conn.WriteToUDP(p.buff[0:p.size], p.addr)
+	if p.addr.IP == nil {
+		_, e := conn.WriteToUDP(p.buff[0:p.size], p.addr)
+		return e
+	}
+	_, e := conn.WriteToUDPAddrPort(p.buff[0:p.size], p.addr.AddrPort())
 	return e
 }
 
-func pktRecv(conn *net.UDPConn, from *net.UDPAddr, deadline *time.Time) (*pktbuff, error) {
+// pktSendEach writes pkts in order with a system call each, it returns how
+// many were sent.
+func pktSendEach(conn *net.UDPConn, pkts []*pktbuff) (int, error) {
+	for i, p := range pkts {
+		if e := p.pktSend(conn); e != nil {
+			return i, e
+		}
+	}
+	return len(pkts), nil
+}
+
+// sameAddr compares two network addresses without allocating.
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
+// addrCache maps the sources seen by a receiving routine to a shared address,
+// so steady traffic does not allocate one per packet. Received addresses are
+// never modified.
+type addrCache map[netip.AddrPort]*net.UDPAddr
+
+const addrCacheSize = 4096
+
+func (c addrCache) get(ap netip.AddrPort) *net.UDPAddr {
+	if a, ok := c[ap]; ok {
+		return a
+	}
+	if len(c) >= addrCacheSize {
+		clear(c)
+	}
+	a := net.UDPAddrFromAddrPort(ap)
+	c[ap] = a
+	return a
+}
+
+func pktRecv(conn *net.UDPConn, from *net.UDPAddr, deadline *time.Time, sources addrCache) (*pktbuff, error) {
 	var (
 		n int
-		a *net.UDPAddr
+		a netip.AddrPort
 		e error
 	)
 	pkt := allocPktbuff()
@@ -60,18 +135,19 @@ func pktRecv(conn *net.UDPConn, from *net.UDPAddr, deadline *time.Time) (*pktbuf
 		conn.SetReadDeadline(*deadline)
 	}
 	for {
-		n, a, e = conn.ReadFromUDP(pkt.buff)
+		n, a, e = conn.ReadFromUDPAddrPort(pkt.buff)
 		if e != nil {
+			pkt.release()
 			return nil, e
 		}
-
-		if from != nil && from.String() != a.String() {
+		a = netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+		if from != nil && !sameAddr(from, net.UDPAddrFromAddrPort(a)) {
 			continue
 		}
 		break
 	}
 	pkt.size = n
-	pkt.addr = a
+	pkt.addr = sources.get(a)
 	return pkt, nil
 }
 
@@ -83,8 +159,9 @@ func ptkRxRoutine(conn *net.UDPConn, addr *net.UDPAddr) (chan *pktbuff, chan err
 			close(io)
 			close(er)
 		}()
+		r := newPktReader(conn, addr)
 		for {
-			p, e := pktRecv(conn, addr, nil)
+			pkts, e := r.recv()
 			if e != nil {
 				if errors.Is(e, net.ErrClosed) {
 					io <- nil
@@ -93,7 +170,9 @@ func ptkRxRoutine(conn *net.UDPConn, addr *net.UDPAddr) (chan *pktbuff, chan err
 				er <- e
 				return
 			}
-			io <- p
+			for _, p := range pkts {
+				io <- p
+			}
 		}
 	}()
 	return io, er
@@ -0,0 +1,234 @@
+package sudp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	punchTimeout = 5 * time.Second
+)
+
+type punchstate struct {
+	started time.Time
+	waiter  chan error
+}
+
+// endpointData packs a virtual address and an IPv4 endpoint in the data field
+// of a control message. A nil address means the peer is not available.
+func endpointData(vaddr uint16, addr *net.UDPAddr) uint64 {
+	var b [8]byte
+	if addr != nil {
+		if ip := addr.IP.To4(); ip != nil {
+			copy(b[0:4], ip)
+			binary.BigEndian.PutUint16(b[4:], uint16(addr.Port))
+		}
+	}
+	binary.BigEndian.PutUint16(b[6:], vaddr)
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func endpointLoad(data uint64) (uint16, *net.UDPAddr) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], data)
+	vaddr := binary.BigEndian.Uint16(b[6:])
+	port := binary.BigEndian.Uint16(b[4:])
+	if port == 0 {
+		return vaddr, nil
+	}
+	return vaddr, &net.UDPAddr{IP: net.IPv4(b[0], b[1], b[2], b[3]), Port: int(port)}
+}
+
+// filterDirect validates packets received from a peer outside the server.
+func (c *ClientConn) filterDirect(pkt *pktbuff) (*peer, *hdr, error) {
+	buf := pkt.head(hdrsz)
+	if buf == nil {
+		return nil, nil, newDrop(DropMalformed, "invalid size - message drop", nil)
+	}
+	src, dst := hdrSrcDst(buf)
+	p, ok := c.direct[src]
+	if !ok || dst != c.vaddr || p.naddr == nil {
+		return nil, nil, newDrop(DropUnknownSource, "invalid source - message drop", nil)
+	}
+	hdr, e := pkt.loadHdr(buf, p.hmackey)
+	if e != nil {
+		return p, nil, newDrop(DropMalformed, "invalid header - message drop", e)
+	}
+	if e := p.inTime(hdr); e != nil {
+		return p, nil, e
+	}
+	return p, hdr, nil
+}
+
+// control handles the control messages received from the server.
+func (c *ClientConn) control(p *peer, ctrl *ctrlmessage) error {
+	if ctrl.isSet(Close) {
+		c.closed(p, CloseReason(ctrl.data))
+		return nil
+	}
+	if p != c.server || !ctrl.isSet(Introduce) {
+		return nil
+	}
+	vaddr, addr := endpointLoad(ctrl.data)
+	d, ok := c.direct[vaddr]
+	if !ok {
+		return nil
+	}
+	if addr == nil {
+		c.punched(vaddr, fmt.Errorf("peer %d: %w for a direct session", vaddr, ErrNotReady))
+		return nil
+	}
+	if _, ok := c.punches[vaddr]; !ok {
+		c.punches[vaddr] = &punchstate{started: time.Now()}
+	}
+	d.naddr = addr
+	return c.punch(d)
+}
+
+// punch sends the packets that open the NAT mappings. The peer with the lowest
+// virtual address initiates the handshake, the other one sends keepalives.
+func (c *ClientConn) punch(d *peer) error {
+	if c.vaddr > d.vaddr {
+		return d.sendCtrl(&c.Conn, ^uint32(0), KeepAlive, 0)
+	}
+	if d.handshake == nil {
+		return d.initiate(&c.Conn, rand.Intn(65536))
+	}
+	rsnd, err := d.handshake.repack(c.private, d.hmackey)
+	if err != nil {
+		return err
+	}
+	rsnd.addr = d.naddr
+	return d.send(rsnd, c.conn)
+}
+
+func (c *ClientConn) punched(vaddr uint16, e error) {
+	st, ok := c.punches[vaddr]
+	if !ok {
+		return
+	}
+	delete(c.punches, vaddr)
+	if st.waiter != nil {
+		st.waiter <- e
+	}
+	if e != nil {
+		c.resetDirect(c.direct[vaddr])
+	}
+}
+
+func (c *ClientConn) resetDirect(d *peer) {
+	d.wipe()
+	d.handshake = nil
+	d.ready = false
+	d.tsync = nil
+	d.ttlm = time.Time{}
+	d.publish()
+}
+
+// keepDirect is run by the control ticker. It drives the punching in progress
+// and keeps alive and rotates the established direct sessions.
+func (c *ClientConn) keepDirect() {
+	for vaddr, st := range c.punches {
+		d := c.direct[vaddr]
+		if d.ready && d.epochs.cEpoch != -1 {
+			d.handshake = nil
+			c.punched(vaddr, nil)
+		} else if time.Since(st.started) > punchTimeout {
+			c.punched(vaddr, fmt.Errorf("punching to %d: %w, using relay", vaddr, ErrHandshakeTimeout))
+		} else if d.naddr != nil {
+			c.punch(d)
+		}
+	}
+	for _, d := range c.direct {
+		if !d.ready {
+			continue
+		}
+		d.epochs.expire(c.timers.grace)
+		if time.Since(d.ttlm) > c.timers.idle {
+			c.log.info("direct session idle - using relay", append(peerAttrs(d), "idle", c.timers.idle)...)
+			c.resetDirect(d)
+			continue
+		}
+		_, punching := c.punches[d.vaddr]
+		switch {
+		case punching:
+		case d.handshake != nil:
+			// A rotation in progress
+			c.retryDirect(d)
+		case d.epochs.cEpoch != -1 && c.vaddr < d.vaddr && time.Since(d.epochs.ctime) > c.timers.lifetime:
+			// Only one end of the session rotates the epochs, as with nodes
+			d.initiate(&c.Conn, d.epochs.cEpoch+1)
+			continue
+		}
+		epoch, _ := d.epochs.current()
+		d.probe(&c.Conn, uint32(epoch), KeepAlive)
+	}
+}
+
+// retryDirect retransmits the rotation handshake of a direct session, which
+// keeps its current epoch if the handshake times out.
+func (c *ClientConn) retryDirect(d *peer) {
+	if !d.handshake.timeRetry(c.timers.handshakeRetry(d)) {
+		return
+	}
+	if d.handshake.tries >= c.opts.Tries {
+		c.log.warn("direct handshake timeout", peerAttrs(d)...)
+		d.stats.hsFail++
+		d.handshake = nil
+		return
+	}
+	if rsnd, e := d.handshake.repack(c.private, d.hmackey); e == nil {
+		rsnd.addr = d.naddr
+		d.send(rsnd, c.conn)
+	}
+}
+
+// Punch tries to establish a direct session with another peer of the server,
+// traversing NATs with the endpoints observed by the server. Both peers must
+// know each other, the remote peer only answers to peers registered with Punch.
+// While there is no direct session, messages to the peer are relayed by the
+// server. Punch returns when the direct session is established or punching fails.
+func (c *ClientConn) Punch(raddr *RemoteAddr) error {
+	if c == nil || !c.open.isOpen() {
+		return ErrClosed
+	}
+	if raddr.PublicKey == nil {
+		return fmt.Errorf("keys not present")
+	}
+	waiter := make(chan error, 1)
+	e := c.call(func() {
+		d, ok := c.direct[raddr.VirtualAddress]
+		if !ok {
+			d = &peer{
+				vaddr:   raddr.VirtualAddress,
+				pubkey:  raddr.PublicKey,
+				hmackey: newHmacKey(raddr.SharedHmacKey),
+			}
+			d.epochs.init()
+			c.direct[d.vaddr] = d
+			c.addSender(d)
+		}
+		if d.ready {
+			waiter <- nil
+			return
+		}
+		c.punches[d.vaddr] = &punchstate{started: time.Now(), waiter: waiter}
+		epoch, _ := c.server.epochs.current()
+		if e := c.server.sendCtrl(&c.Conn, uint32(epoch), Rendezvous, uint64(d.vaddr)); e != nil {
+			delete(c.punches, d.vaddr)
+			waiter <- e
+		}
+	})
+	if e != nil {
+		return e
+	}
+	select {
+	case e = <-waiter:
+		return e
+	case <-c.ch.done:
+		return ErrClosed
+	}
+}
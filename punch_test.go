@@ -0,0 +1,64 @@
+package sudp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// directEpoch returns the current epoch of the direct session of c with vaddr.
+func directEpoch(t *testing.T, c *ClientConn, vaddr uint16) (epoch int, ready bool) {
+	t.Helper()
+	if err := c.call(func() {
+		if d, ok := c.direct[vaddr]; ok {
+			epoch, ready = d.epochs.cEpoch, d.ready
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return epoch, ready
+}
+
+// The lower virtual address rotates the epochs of a direct session.
+func TestDirectRotation(t *testing.T) {
+	opts := &ClientOpts{
+		KeepAliveInterval: 20 * time.Millisecond,
+		HandshakeRetry:    50 * time.Millisecond,
+		EpochLifetime:     200 * time.Millisecond,
+	}
+	_, clients, remotes := newStar(t, 2, &ServerOpts{Relay: true}, opts)
+	errc := make(chan error, 1)
+	go func() { errc <- clients[1].Punch(remotes[0]) }()
+	if err := clients[0].Punch(remotes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	first, _ := directEpoch(t, clients[0], 2)
+
+	time.Sleep(3 * opts.EpochLifetime)
+	epoch, ready := directEpoch(t, clients[0], 2)
+	if !ready || epoch <= first {
+		t.Fatalf("direct session ready %v in epoch %d, want a rotation from %d", ready, epoch, first)
+	}
+	if remote, _ := directEpoch(t, clients[1], 1); remote != epoch {
+		t.Fatalf("remote epoch %d, want %d", remote, epoch)
+	}
+	if err := clients[1].SendTo([]byte("rotated"), 1); err != nil {
+		t.Fatal(err)
+	}
+	b, from, err := clients[0].RecvFrom()
+	if err != nil || string(b) != "rotated" || from != 2 {
+		t.Fatalf("RecvFrom = %q, %d, %v", b, from, err)
+	}
+}
+
+// Punching to a peer without a session fails with ErrNotReady.
+func TestPunchUnavailable(t *testing.T) {
+	_, clients, remotes := newStar(t, 2, &ServerOpts{Relay: true}, nil)
+	clients[1].Close()
+	if err := clients[0].Punch(remotes[1]); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("Punch = %v, want %v", err, ErrNotReady)
+	}
+}
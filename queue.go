@@ -0,0 +1,121 @@
+package sudp
+
+import (
+	"fmt"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a message received while the receive
+// queue is full.
+type OverflowPolicy int
+
+const (
+	OverflowBlock        OverflowPolicy = iota // Wait for the application, stalling the connection loop
+	OverflowDropNewest                         // Drop the message received
+	OverflowDropOldest                         // Drop the oldest queued message to make room
+	OverflowBlockTimeout                       // Wait up to the queue timeout, then drop the message received
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop newest"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowBlockTimeout:
+		return "block with timeout"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+const (
+	defaultQueueSize    = 10
+	defaultQueueTimeout = 100 * time.Millisecond
+)
+
+// QueuePolicy bounds the messages received and not yet read by Recv, so a slow
+// application does not have to stall the connection loop. It only applies to
+// the default port: every Channel has its own queue of 64 messages, dropping
+// the newest when full, and streams drop the segments they can not take, which
+// are recovered by retransmission.
+type QueuePolicy struct {
+	Size     int            // Messages waiting for Recv, default 10
+	Overflow OverflowPolicy // Applied when the queue is full, default OverflowBlock
+	Timeout  time.Duration  // Longest wait of OverflowBlockTimeout, default 100ms
+}
+
+// queuePolicy validates q and fills in its defaults, q may be nil.
+func queuePolicy(q *QueuePolicy) (QueuePolicy, error) {
+	var p QueuePolicy
+	if q != nil {
+		p = *q
+	}
+	if p.Size < 0 || p.Timeout < 0 {
+		return p, fmt.Errorf("negative receive queue size or timeout")
+	}
+	if p.Overflow < OverflowBlock || p.Overflow > OverflowBlockTimeout {
+		return p, fmt.Errorf("invalid receive queue overflow policy %v", p.Overflow)
+	}
+	if p.Size == 0 {
+		p.Size = defaultQueueSize
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultQueueTimeout
+	}
+	return p, nil
+}
+
+// enqueue hands a received message to Recv following the overflow policy. A
+// blocked delivery gives up when the connection is closing.
+func (c *Conn) enqueue(msg *message) {
+	select {
+	case c.ch.userRx <- msg:
+		return
+	default:
+	}
+	switch c.queue.Overflow {
+	case OverflowDropNewest:
+		c.discard(msg, "receive queue full")
+		return
+	case OverflowDropOldest:
+		select {
+		case old := <-c.ch.userRx:
+			c.discard(old, "receive queue full")
+		default:
+		}
+		select {
+		case c.ch.userRx <- msg:
+		default:
+			// Another worker took the room
+			c.discard(msg, "receive queue full")
+		}
+		return
+	case OverflowBlockTimeout:
+		t := time.NewTimer(c.queue.Timeout)
+		defer t.Stop()
+		select {
+		case c.ch.userRx <- msg:
+		case <-t.C:
+			c.discard(msg, "receive queue full")
+		case <-c.ch.quit:
+			c.discard(msg, "connection closing")
+		}
+		return
+	}
+	select {
+	case c.ch.userRx <- msg:
+	case <-c.ch.quit:
+		c.discard(msg, "connection closing")
+	}
+}
+
+// discard counts and releases a received message that could not be delivered.
+func (c *Conn) discard(msg *message, reason string) {
+	c.slock.Lock()
+	c.stats.recvDrops++
+	c.slock.Unlock()
+	c.log.drop(reason, "message dropped", "vaddr", msg.addr, "port", msg.port)
+	msg.release()
+}
@@ -0,0 +1,60 @@
+package sudp
+
+import (
+	"testing"
+	"time"
+)
+
+// closes fails the test if close does not return in time.
+func closes(t *testing.T, name string, close func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		close()
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked by a full receive queue", name)
+	}
+}
+
+// A loop blocked on a full receive queue does not block Close.
+func TestBlockedQueueClose(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowBlockTimeout} {
+		t.Run(policy.String(), func(t *testing.T) {
+			queue := &QueuePolicy{Size: 1, Overflow: policy, Timeout: time.Hour}
+			srv, cli := newPair(t, &ServerOpts{RecvQueue: queue}, &ClientOpts{RecvQueue: queue})
+			// The server sends once it has heard from the client
+			if err := cli.Send([]byte("ready")); err != nil {
+				t.Fatal(err)
+			}
+			recvAll(t, srv, 1)
+			for range 4 {
+				if err := cli.Send([]byte("unread")); err != nil {
+					t.Fatal(err)
+				}
+				if err := srv.SendTo([]byte("unread"), 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Let both loops block on their queues
+			time.Sleep(100 * time.Millisecond)
+			closes(t, "client Close", func() { cli.Close() })
+			closes(t, "server Close", srv.Close)
+		})
+	}
+}
+
+func TestQueuePolicy(t *testing.T) {
+	p, err := queuePolicy(nil)
+	if err != nil || p.Size != defaultQueueSize || p.Overflow != OverflowBlock || p.Timeout != defaultQueueTimeout {
+		t.Fatalf("queuePolicy(nil) = %+v, %v", p, err)
+	}
+	for _, q := range []QueuePolicy{{Size: -1}, {Timeout: -1}, {Overflow: OverflowBlockTimeout + 1}} {
+		if _, err := queuePolicy(&q); err == nil {
+			t.Errorf("queuePolicy(%+v) accepted", q)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package sudp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ConnState is the state of the session of a ClientConn with its server.
+type ConnState int32
+
+const (
+	StateConnecting ConnState = iota // Handshake in progress
+	StateUp                          // Session established
+	StateDown                        // Server unreachable, waiting to reconnect
+	StateClosed                      // Connection closed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateUp:
+		return "up"
+	case StateDown:
+		return "down"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int32(s))
+}
+
+// ReconnectPolicy enables the automatic reconnection of a ClientConn once
+// established. When every server endpoint fails, or the server shuts down, the
+// client waits an exponential backoff with jitter and starts over, instead of
+// closing. A client removed, kicked or rekeyed by the server is closed unless
+// AfterKick is set.
+type ReconnectPolicy struct {
+	MinBackoff  time.Duration // First wait, default 1s
+	MaxBackoff  time.Duration // Max wait, default 30s
+	Jitter      float64       // Random fraction added or subtracted to each wait, default 0.2
+	MaxAttempts int           // Reconnection attempts before closing, 0 retries forever
+	QueueSize   int           // Messages queued while the server is unreachable, 0 drops them
+	AfterKick   bool          // Reconnect also when the server closes the session on purpose
+}
+
+// retries reports whether the client reconnects after the server closed its
+// session for reason.
+func (r *ReconnectPolicy) retries(reason CloseReason) bool {
+	return reason == CloseNormal || r.AfterKick
+}
+
+func (r *ReconnectPolicy) backoff(attempt int) time.Duration {
+	minb, maxb, jitter := r.MinBackoff, r.MaxBackoff, r.Jitter
+	if minb <= 0 {
+		minb = time.Second
+	}
+	if maxb <= 0 {
+		maxb = 30 * time.Second
+	}
+	if jitter <= 0 {
+		jitter = 0.2
+	}
+	d := maxb
+	if attempt < 32 && minb<<attempt < maxb {
+		d = minb << attempt
+	}
+	delta := time.Duration(float64(d) * jitter * (2*rand.Float64() - 1))
+	return max(d+delta, 0)
+}
+
+func (c *ClientConn) State() ConnState {
+	return ConnState(c.state.Load())
+}
+
+func (c *ClientConn) setState(s ConnState) {
+	if ConnState(c.state.Swap(int32(s))) == s {
+		return
+	}
+	if s == StateUp {
+		c.attempts = 0
+		c.flushQueue()
+	}
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(s)
+	}
+}
+
+// down resets the session with the server and schedules a reconnection.
+// It returns false when the reconnection attempts are exhausted.
+func (c *ClientConn) down() bool {
+	r := c.opts.Reconnect
+	if r.MaxAttempts > 0 && c.attempts >= r.MaxAttempts {
+		return false
+	}
+	c.server.wipe()
+	c.server.handshake = nil
+	c.server.ready = false
+	c.server.tsync = nil
+	c.server.ttlm = time.Time{}
+	c.server.publish()
+	c.resetStreams(allStreams)
+	c.retryAt = time.Now().Add(r.backoff(c.attempts))
+	c.attempts++
+	c.log.info("server unreachable", "vaddr", c.server.vaddr, "retry", c.retryAt, "attempt", c.attempts)
+	c.setState(StateDown)
+	return true
+}
+
+// reconnect starts over with the preferred server endpoint.
+func (c *ClientConn) reconnect() {
+	c.failed = 0
+	c.active = len(c.endpoints) - 1
+	c.failover()
+	c.setState(StateConnecting)
+}
+
+// enqueue keeps a message sent while the session is down, it returns false
+// when the message must be dropped.
+func (c *ClientConn) enqueue(msg *message) bool {
+	if c.opts.Reconnect == nil || len(c.queue) >= c.opts.Reconnect.QueueSize {
+		return false
+	}
+	msg.buff = bytes.Clone(msg.buff)
+	c.queue = append(c.queue, msg)
+	return true
+}
+
+func (c *ClientConn) flushQueue() {
+	if len(c.queue) == 0 {
+		return
+	}
+	if e := c.server.sendDataBatch(c.vaddr, c.queue, c.writer); e != nil {
+		c.log.warn("sending queued messages", append(peerAttrs(c.server), "err", e)...)
+	}
+	c.queue = nil
+}
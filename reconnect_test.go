@@ -0,0 +1,159 @@
+package sudp
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	r := &ReconnectPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.1}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000, 1000} {
+		want *= time.Millisecond
+		for range 20 {
+			if d := r.backoff(attempt); d < want*9/10 || d > want*11/10 {
+				t.Fatalf("backoff(%d) = %v, want %v ±10%%", attempt, d, want)
+			}
+		}
+	}
+	// Defaults: 1s doubling up to 30s, ±20%
+	var def ReconnectPolicy
+	for attempt, want := range map[int]time.Duration{0: time.Second, 3: 8 * time.Second, 10: 30 * time.Second, 64: 30 * time.Second} {
+		if d := def.backoff(attempt); d < want*8/10 || d > want*12/10 {
+			t.Fatalf("default backoff(%d) = %v, want %v ±20%%", attempt, d, want)
+		}
+	}
+}
+
+// restartable is a server that can be stopped and started again on the same
+// address, with a client reconnecting to it.
+type restartable struct {
+	t      *testing.T
+	skey   *ecdsa.PrivateKey
+	raddr  *RemoteAddr
+	naddr  *net.UDPAddr
+	srv    *ServerConn
+	cli    *ClientConn
+	states chan ConnState
+}
+
+func newRestartable(t *testing.T, r *ReconnectPolicy) *restartable {
+	skey, _ := GenerateKey()
+	ckey, _ := GenerateKey()
+	hmkey := []byte("test hmac key")
+	s := &restartable{
+		t:      t,
+		skey:   skey,
+		raddr:  &RemoteAddr{VirtualAddress: 1, PublicKey: &ckey.PublicKey, SharedHmacKey: hmkey},
+		naddr:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		states: make(chan ConnState, 64),
+	}
+	s.start()
+	s.naddr = s.srv.conns[0].LocalAddr().(*net.UDPAddr)
+	cli, err := Connect(&LocalAddr{VirtualAddress: 1, PrivateKey: ckey},
+		&RemoteAddr{PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: s.naddr},
+		&ClientOpts{
+			Tries:             2,
+			KeepAliveInterval: 20 * time.Millisecond,
+			HandshakeRetry:    50 * time.Millisecond,
+			Reconnect:         r,
+			OnStateChange:     func(st ConnState) { s.states <- st },
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	s.cli = cli
+	return s
+}
+
+func (s *restartable) start() {
+	srv, err := Listen(&LocalAddr{PrivateKey: s.skey, NetworkAddress: s.naddr}, []*RemoteAddr{s.raddr}, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(srv.Close)
+	s.srv = srv
+}
+
+// next returns the next state change of the client.
+func (s *restartable) next() ConnState {
+	s.t.Helper()
+	select {
+	case st := <-s.states:
+		return st
+	case <-time.After(5 * time.Second):
+		s.t.Fatalf("no state change from %v", s.cli.State())
+	}
+	return 0
+}
+
+// A client queues what it sends while the server is down, up to the queue
+// size, and delivers it once the restarted server is reachable again.
+func TestReconnectRestart(t *testing.T) {
+	s := newRestartable(t, &ReconnectPolicy{MinBackoff: 50 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, QueueSize: 2})
+	if st := s.next(); st != StateUp {
+		t.Fatalf("state %v, want %v", st, StateUp)
+	}
+	s.srv.Close()
+	if st := s.next(); st != StateDown {
+		t.Fatalf("state %v after the server closed, want %v", st, StateDown)
+	}
+	for i, want := range []error{nil, nil, ErrNotReady} {
+		if err := s.cli.Send([]byte{byte(i)}); err != want {
+			t.Fatalf("Send %d while down = %v, want %v", i, err, want)
+		}
+	}
+
+	s.start()
+	// Attempts may fail until the server is up, always down to connecting
+	last := StateDown
+	for last != StateUp {
+		st := s.next()
+		switch {
+		case last == StateDown && st == StateConnecting:
+		case last == StateConnecting && (st == StateDown || st == StateUp):
+		default:
+			t.Fatalf("state %v after %v", st, last)
+		}
+		last = st
+	}
+	for i, b := range recvAll(t, s.srv, 2) {
+		if len(b) != 1 || b[0] != byte(i) {
+			t.Fatalf("queued message %d = %v", i, b)
+		}
+	}
+	if err := s.cli.Send([]byte("up")); err != nil {
+		t.Fatal(err)
+	}
+	recvAll(t, s.srv, 1)
+}
+
+// Removal by the server closes a reconnecting client unless AfterKick is set.
+func TestReconnectRemoved(t *testing.T) {
+	s := newRestartable(t, &ReconnectPolicy{MinBackoff: 50 * time.Millisecond})
+	s.next()
+	if err := s.srv.RemovePeer(1); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CloseError
+	if err := s.cli.GetErrors(); !errors.As(err, &ce) || ce.Reason != CloseRemoved {
+		t.Fatalf("GetErrors = %v, want a %v close", err, CloseRemoved)
+	}
+	if st := s.cli.State(); st != StateClosed {
+		t.Fatalf("state %v, want %v", st, StateClosed)
+	}
+
+	s = newRestartable(t, &ReconnectPolicy{MinBackoff: 50 * time.Millisecond, AfterKick: true})
+	s.next()
+	if err := s.srv.Kick(1, CloseKicked); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ConnState{StateDown, StateConnecting, StateUp} {
+		if st := s.next(); st != want {
+			t.Fatalf("state %v after a kick, want %v", st, want)
+		}
+	}
+}
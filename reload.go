@@ -0,0 +1,142 @@
+package sudp
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConfigWatcher reloads the peers of a running ServerConn from the file read
+// by LoadServerConfig, when the file changes or the process receives SIGHUP.
+type ConfigWatcher struct {
+	server   *ServerConn
+	path     string
+	local    string // Local section in use, it can not change without a restart
+	modified time.Time
+	size     int64
+	onReload func(error)
+	hup      chan os.Signal
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// WatchConfig starts watching path, checking for changes every interval
+// (default 5s). The peers of the file are applied at once. onReload, if not
+// nil, receives the result of every reload; an invalid file is rejected and
+// the running peers are kept.
+func (s *ServerConn) WatchConfig(path string, interval time.Duration, onReload func(error)) (*ConfigWatcher, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := LoadServerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := config.LocalAddress()
+	if err != nil {
+		return nil, err
+	}
+	if laddr.VirtualAddress != s.vaddr || !laddr.PrivateKey.Equal(s.private) {
+		return nil, fmt.Errorf("local section of %s does not match the server", path)
+	}
+	w := &ConfigWatcher{
+		server:   s,
+		path:     path,
+		local:    localKey(laddr),
+		onReload: onReload,
+		hup:      make(chan os.Signal, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	w.modified, w.size = info.ModTime(), info.Size()
+	signal.Notify(w.hup, syscall.SIGHUP)
+	go w.watch(interval)
+	return w, nil
+}
+
+func localKey(laddr *LocalAddr) string {
+	return fmt.Sprintf("%d %s", laddr.VirtualAddress, laddr.NetworkAddress)
+}
+
+func (w *ConfigWatcher) watch(interval time.Duration) {
+	defer close(w.done)
+	defer signal.Stop(w.hup)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.server.ch.done:
+			return
+		case <-w.hup:
+			w.report(w.Reload())
+		case <-tick.C:
+			info, err := os.Stat(w.path)
+			if err != nil {
+				w.report(err)
+				continue
+			}
+			if info.ModTime().Equal(w.modified) && info.Size() == w.size {
+				continue
+			}
+			w.modified, w.size = info.ModTime(), info.Size()
+			w.report(w.Reload())
+		}
+	}
+}
+
+func (w *ConfigWatcher) report(e error) {
+	if e != nil {
+		w.server.log.warn("config rejected", "path", w.path, "err", e)
+	}
+	if w.onReload != nil {
+		w.onReload(e)
+	}
+}
+
+// Reload reads the file and applies its peers. Nothing is applied if the
+// file is not valid.
+func (w *ConfigWatcher) Reload() error {
+	config, err := LoadServerConfig(w.path)
+	if err != nil {
+		return err
+	}
+	laddr, err := config.LocalAddress()
+	if err != nil {
+		return err
+	}
+	if localKey(laddr) != w.local || !laddr.PrivateKey.Equal(w.server.private) {
+		return fmt.Errorf("local section changed, a restart is required")
+	}
+	raddrs, err := config.PeersAddresses()
+	if err != nil {
+		return err
+	}
+	added, rekeyed, removed, err := w.server.sync(raddrs)
+	if err != nil {
+		return err
+	}
+	w.server.log.info("config reloaded", "path", w.path, "added", added, "rekeyed", rekeyed, "removed", removed)
+	return nil
+}
+
+// Close stops watching the file, the running peers are kept.
+func (w *ConfigWatcher) Close() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
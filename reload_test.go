@@ -0,0 +1,153 @@
+package sudp
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configFile writes the server configuration of srv with peers to path.
+func configFile(t *testing.T, path string, srv *ServerConn, peers map[uint16]*ecdsa.PublicKey) {
+	t.Helper()
+	priv, err := MarshalECDSAPrivateKey(srv.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyType, hmkey, naddr := "string", "test hmac key", "127.0.0.1:0"
+	config := ServerConfig{
+		Server: LocalConfig{VirtualAddress: int(srv.vaddr), NetworkAddress: &naddr, KeyType: &keyType, PrivateKey: string(priv)},
+		Peers:  []RemoteConfig{},
+	}
+	for vaddr, key := range peers {
+		pub, err := MarshalECDSAPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Peers = append(config.Peers, RemoteConfig{VirtualAddress: int(vaddr), SharedHmacKey: &hmkey,
+			KeyType: &keyType, PublicKey: string(pub)})
+	}
+	b, err := json.Marshal(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// watch starts watching the configuration of srv at path and returns the
+// results of the reloads.
+func watch(t *testing.T, srv *ServerConn, path string) <-chan error {
+	t.Helper()
+	reloads := make(chan error, 8)
+	w, err := srv.WatchConfig(path, 10*time.Millisecond, func(e error) { reloads <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	return reloads
+}
+
+func reloaded(t *testing.T, reloads <-chan error) error {
+	t.Helper()
+	select {
+	case e := <-reloads:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("config not reloaded")
+	}
+	return nil
+}
+
+// A rewritten config adds and removes peers without touching the others.
+func TestWatchConfig(t *testing.T) {
+	srv, clients, remotes := newStar(t, 2, nil, nil)
+	for _, c := range clients {
+		if err := c.Send([]byte("up")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recvAll(t, srv, 2)
+	before, _, _ := srv.Peer(1)
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	configFile(t, path, srv, map[uint16]*ecdsa.PublicKey{1: remotes[0].PublicKey, 2: remotes[1].PublicKey})
+	reloads := watch(t, srv, path)
+
+	// A longer virtual address changes the size, whatever the mtime resolution
+	key, _ := GenerateKey()
+	configFile(t, path, srv, map[uint16]*ecdsa.PublicKey{1: remotes[0].PublicKey, 30: &key.PublicKey})
+	if err := reloaded(t, reloads); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := srv.Peer(2); ok {
+		t.Fatal("peer 2 not removed")
+	}
+	var ce *CloseError
+	if err := clients[1].GetErrors(); !errors.As(err, &ce) || ce.Reason != CloseRemoved {
+		t.Fatalf("peer 2: GetErrors = %v, want a %v close", err, CloseRemoved)
+	}
+	after, _, _ := srv.Peer(1)
+	if !after.Ready || after.Epoch != before.Epoch || !after.EpochStarted.Equal(before.EpochStarted) {
+		t.Fatalf("session of peer 1 changed: %+v, was %+v", after, before)
+	}
+	if err := clients[0].Send([]byte("unaffected")); err != nil {
+		t.Fatal(err)
+	}
+	if b := recvAll(t, srv, 1); string(b[0]) != "unaffected" {
+		t.Fatalf("RecvFrom = %q", b[0])
+	}
+	cli, err := connectTo(t, srv, 30, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Send([]byte("added")); err != nil {
+		t.Fatal(err)
+	}
+	recvAll(t, srv, 1)
+}
+
+// An invalid config is reported and the running peers are kept.
+func TestWatchConfigInvalid(t *testing.T) {
+	srv, clients, remotes := newStar(t, 1, nil, nil)
+	path := filepath.Join(t.TempDir(), "server.json")
+	configFile(t, path, srv, map[uint16]*ecdsa.PublicKey{1: remotes[0].PublicKey})
+	reloads := watch(t, srv, path)
+
+	for _, c := range []struct {
+		config, want string
+	}{
+		{`{"local": `, "unexpected EOF"},
+		{`{"local": {"virtual_address": 0, "key_type": "string", "private_key": ""}, "peers": []}`, "local.network_address"},
+		{`{"local": {"virtual_address": 0, "network_address": "127.0.0.1:0", "key_type": "pem"}, "peers": []}`, "key_type"},
+	} {
+		if err := os.WriteFile(path, []byte(c.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloaded(t, reloads); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("reload of %s = %v, want an error about %s", c.config, err, c.want)
+		}
+	}
+	// A valid file with the server as a peer is rejected as a whole
+	key, _ := GenerateKey()
+	configFile(t, path, srv, map[uint16]*ecdsa.PublicKey{0: &key.PublicKey, 1: remotes[0].PublicKey})
+	if err := reloaded(t, reloads); err == nil || !strings.Contains(err.Error(), "virtual address of the server") {
+		t.Fatalf("reload = %v, want an error about the server address", err)
+	}
+
+	peers, err := srv.Peers()
+	if err != nil || len(peers) != 1 || peers[0].VirtualAddress != 1 {
+		t.Fatalf("Peers = %+v, %v", peers, err)
+	}
+	if err := clients[0].Send([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if b := recvAll(t, srv, 1); string(b[0]) != "kept" {
+		t.Fatalf("RecvFrom = %q", b[0])
+	}
+}
@@ -0,0 +1,30 @@
+package sudp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenReusePort opens a socket on addr that the kernel load balances with
+// the other sockets of the same port.
+func listenReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var e error
+			if err := c.Control(func(fd uintptr) {
+				e = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return e
+		},
+	}
+	conn, e := lc.ListenPacket(context.Background(), "udp4", addr.String())
+	if e != nil {
+		return nil, e
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sudp
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,45 @@
+package sudp
+
+import "time"
+
+const (
+	rttInitial = time.Second
+	rttMinRTO  = 200 * time.Millisecond
+	rttMaxRTO  = 60 * time.Second
+	rttGranule = 10 * time.Millisecond
+)
+
+// rttStats keeps a smoothed round trip time estimation as described in RFC 6298.
+type rttStats struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	min     time.Duration
+	latest  time.Duration
+	samples int
+}
+
+func (r *rttStats) update(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	r.latest = sample
+	if r.samples == 0 || sample < r.min {
+		r.min = sample
+	}
+	if r.samples == 0 {
+		r.srtt = sample
+		r.rttvar = sample / 2
+	} else {
+		r.rttvar = (3*r.rttvar + (r.srtt - sample).Abs()) / 4
+		r.srtt = (7*r.srtt + sample) / 8
+	}
+	r.samples++
+}
+
+func (r *rttStats) rto() time.Duration {
+	if r.samples == 0 {
+		return rttInitial
+	}
+	rto := r.srtt + max(rttGranule, 4*r.rttvar)
+	return min(max(rto, rttMinRTO), rttMaxRTO)
+}
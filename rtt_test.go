@@ -0,0 +1,82 @@
+package sudp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	var r rttStats
+	if rto := r.rto(); rto != rttInitial {
+		t.Fatalf("rto without samples %v, want %v", rto, rttInitial)
+	}
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		sample, srtt, rttvar, min time.Duration
+	}{
+		{100 * ms, 100 * ms, 50 * ms, 100 * ms},
+		{60 * ms, 95 * ms, 47500 * time.Microsecond, 60 * ms},
+		{200 * ms, 108125 * time.Microsecond, 61875 * time.Microsecond, 60 * ms},
+		{0, 108125 * time.Microsecond, 61875 * time.Microsecond, 60 * ms}, // Ignored
+	} {
+		r.update(tt.sample)
+		if r.srtt != tt.srtt || r.rttvar != tt.rttvar || r.min != tt.min {
+			t.Fatalf("sample %v: srtt %v rttvar %v min %v, want %v %v %v",
+				tt.sample, r.srtt, r.rttvar, r.min, tt.srtt, tt.rttvar, tt.min)
+		}
+	}
+	if rto := r.rto(); rto != r.srtt+4*r.rttvar {
+		t.Fatalf("rto %v, want %v", rto, r.srtt+4*r.rttvar)
+	}
+	if rto := (&rttStats{srtt: ms, rttvar: ms, samples: 1}).rto(); rto != rttMinRTO {
+		t.Fatalf("rto of a fast path %v, want %v", rto, rttMinRTO)
+	}
+	if rto := (&rttStats{srtt: time.Minute, rttvar: time.Minute, samples: 1}).rto(); rto != rttMaxRTO {
+		t.Fatalf("rto of a slow path %v, want %v", rto, rttMaxRTO)
+	}
+}
+
+// Probes measure the round trip time of a session and the handshake retries
+// of the next epoch back off from the measured RTO.
+func TestRTTProbes(t *testing.T) {
+	srv, cli := newPair(t, nil, &ClientOpts{KeepAliveInterval: 20 * time.Millisecond})
+	waitFor(t, "the round trip time of the server", func() bool {
+		info, _, _ := srv.Peer(1)
+		return info.RTT > 0 && info.MinRTT > 0 && info.MinRTT <= info.RTT
+	})
+	waitFor(t, "the round trip time of the client", func() bool {
+		info, _ := cli.Info()
+		return info.RTT > 0 && info.RTTVar > 0 && info.MinRTT > 0
+	})
+
+	var retries []time.Duration
+	if err := cli.call(func() {
+		p := cli.server
+		if p.rtt.samples == 0 {
+			return
+		}
+		saved := p.handshake
+		defer func() { p.handshake = saved }()
+		p.handshake = &handshakestate{}
+		for tries := range 6 {
+			p.handshake.tries = tries
+			retries = append(retries, cli.timers.handshakeRetry(p))
+		}
+		if want := p.rtt.rto(); retries[0] != want {
+			t.Errorf("first retry %v, want the rto %v", retries[0], want)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(retries) == 0 {
+		t.Fatal("no samples in the client loop")
+	}
+	for i := 1; i < len(retries); i++ {
+		if want := min(2*retries[i-1], cli.timers.retry); retries[i] != want {
+			t.Fatalf("retry %v after %v, want %v", retries[i], retries[i-1], want)
+		}
+	}
+	if retries[len(retries)-1] != cli.timers.retry {
+		t.Fatalf("retries %v not capped at %v", retries, cli.timers.retry)
+	}
+}
@@ -1,115 +1,268 @@
 package sudp
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"sync"
 	"time"
 )
 
 type ServerConn struct {
-	peerMap map[uint16]*peer
+	workers []*worker
+	conns   []*net.UDPConn // Sockets of the server, the first one sends
+	opts    *ServerOpts
+	timers  timers
 	Conn
 }
 
-func (s *ServerConn) filterPacket(pkt *pktbuff) (*hdr, error) {
+type ServerOpts struct {
+	Relay          bool                       // Forward messages addressed to other peers
+	RelayACL       func(src, dst uint16) bool // Relay policy, nil allows every pair of peers
+	IdleTimeout    time.Duration              // Peer silence before closing its session, default 5s
+	PrevEpochGrace time.Duration              // Previous epoch accepted after a rotation, 0 until the next one
+	Events         func(Event)                // Session events, called from the server workers, it must not block
+	Logger         *slog.Logger               // Optional, nothing is logged without it
+	Workers        int                        // Loops sharing the peers by virtual address, default 1
+	ReusePort      bool                       // One SO_REUSEPORT socket per worker, Linux only
+	RecvQueue      *QueuePolicy               // Optional, 10 messages blocking the workers when full
+}
+
+func (s *ServerConn) filterPacket(w *worker, pkt *pktbuff) (*peer, *hdr, error) {
 	buf := pkt.head(hdrsz)
+	if buf == nil {
+		return nil, nil, newDrop(DropMalformed, "invalid size - message drop", nil)
+	}
 	src, dst := hdrSrcDst(buf)
 
-	peer, ok := s.peerMap[src]
-	if !ok || dst != s.vaddr {
-		return nil, newError("invalid source - message drop", nil)
+	peer, ok := w.peerMap[src]
+	if !ok {
+		return nil, nil, newDrop(DropUnknownSource, "invalid source - message drop", nil)
+	}
+	if dst != s.vaddr && !s.opts.Relay {
+		return peer, nil, newDrop(DropUnknownSource, "invalid destination - message drop", nil)
 	}
 
-	hdr, e := hdrLoad(buf, peer.hmackey)
+	hdr, e := pkt.loadHdr(buf, peer.hmackey)
 	if e != nil {
-		return nil, newError("invalid header - message drop", e)
+		return peer, nil, newDrop(DropMalformed, "invalid header - message drop", e)
+	}
+	if dst != s.vaddr && hdr.kind != typeData && hdr.kind != typeStream {
+		return peer, nil, newDrop(DropUnknownSource, "invalid destination - message drop", nil)
+	}
+	if !peer.acl.allowSource(pkt.addr) {
+		return peer, nil, newDrop(DropDenied, fmt.Sprintf("acl: source %s of %d not allowed - message drop", pkt.addr, src), nil)
 	}
 
-	if peer.tsync == nil {
-		if peer.tsync, e = newTimeSync(hdr.time); e != nil {
-			return nil, newError("not in time, peer time not well configured - message drop", e)
-		}
-	} else if !peer.tsync.inTime(hdr.time) {
-		return nil, newError(fmt.Sprintf("not in time %d, out of sync - message drop", hdr.time), nil)
+	if e := peer.inTime(hdr); e != nil {
+		return peer, nil, e
 	}
-	return hdr, nil
+	return peer, hdr, nil
 }
 
+// serve starts the workers and the readers of the sockets, and stops them when
+// the server is closed or a socket fails.
 func (s *ServerConn) serve() {
-	tick := time.NewTicker(time.Second)
+	var workers sync.WaitGroup
+	stop := make(chan struct{})
+	for _, w := range s.workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.work(w, stop)
+		}()
+	}
+	for _, conn := range s.conns {
+		go s.receive(conn, stop)
+	}
+
+	var err error
+	readers := len(s.conns)
+	select {
+	case <-s.ch.exit:
+		for _, w := range s.workers {
+			s.callIn(w, func() {
+				for _, peer := range w.peerMap {
+					s.drop(peer, CloseNormal)
+				}
+			})
+		}
+	case e := <-s.ch.errNRx:
+		if errors.Is(e, net.ErrClosed) {
+			err = ErrUnexpectedClose
+		} else {
+			err = fmt.Errorf("at reception %w -> panic", e)
+		}
+		// The socket that failed is no longer read
+		readers--
+		s.ch.stop()
+	}
+	// The readers discard the packets from now on
+	close(stop)
+	workers.Wait()
+	s.open.setStat(statClose)
+	s.release()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	for ; readers > 0; readers-- {
+		if e := <-s.ch.errNRx; !errors.Is(e, net.ErrClosed) && err == nil {
+			err = e
+		}
+	}
+	s.err <- err
+	s.ch.close()
+}
+
+// work is the loop of a worker, the first one also sends the messages queued
+// by sendMessage.
+func (s *ServerConn) work(w *worker, stop chan struct{}) {
+	tick := time.NewTicker(s.timers.serverTick())
+	defer tick.Stop()
+	var userTx chan *message
+	if w == s.workers[0] {
+		userTx = s.ch.userTx
+	}
 	for {
 		select {
-		case <-s.ch.exit:
-			goto exit
-		case pkt := <-s.ch.netRx:
-			if pkt == nil {
-				s.open.setStat(statClose)
-				s.err <- fmt.Errorf("unexpected close")
-				return
-			}
-			hdr, e := s.filterPacket(pkt)
-			if e != nil {
-				log(Warn, fmt.Sprintf("filter: %v", e))
-				continue
-			}
-			peer, _ := s.peerMap[hdr.src]
-			e = peer.handlePacket(hdr, pkt, s.private, s.ch.userRx, s.conn)
-			if e != nil {
-				log(Warn, fmt.Sprintf("at package handle - %v", e))
-			}
-		case e := <-s.ch.errNRx:
-			s.open.setStat(statClose)
-			s.err <- fmt.Errorf("at reception %v -> panic", e)
+		case <-stop:
 			return
-		case msg := <-s.ch.userTx:
-			peer, ok := s.peerMap[msg.addr]
-			if !ok || !peer.ready {
-				s.ch.errUTx <- newError("not ready", nil)
+		case pkt := <-w.netRx:
+			peer, hdr, e := s.filterPacket(w, pkt)
+			if e != nil {
+				s.dropped(peer, e)
+				s.logDrop(peer, pkt.addr, e)
+				pkt.release()
 				continue
 			}
-			e := peer.sendDataPacket(s.vaddr, msg.buff, s.conn)
+			// The packet is released by handlePacket
+			prev, addr, kind := peer.track(), pkt.addr, hdr.kind
+			e = peer.handlePacket(hdr, pkt, &s.Conn)
 			if e != nil {
-				s.ch.errUTx <- newError("sending data packet:", e)
-				continue
+				s.dropped(peer, e)
+				s.logDrop(peer, addr, e)
+				if kind == typeClientHandshake {
+					s.handshakeFailed(peer, addr, e)
+				}
 			}
-			s.ch.errUTx <- nil
-
+			s.changed(peer, prev)
+		case f := <-w.calls:
+			f()
+		case msg := <-userTx:
+			s.ch.errUTx <- s.sendQueued(msg)
 		case <-tick.C:
-			for _, peer := range s.peerMap {
-				if peer.ready && time.Now().Sub(peer.ttlm) > 5*time.Second {
-					log(Info, fmt.Sprintf("last activity for %d more than 5 sec ago - close connection", peer.vaddr))
-					peer.epochs.init()
-					peer.naddr = nil
-					peer.ready = false
-					peer.tsync = nil
-					peer.ttlm = time.Time{}
+			for _, peer := range w.peerMap {
+				peer.epochs.expire(s.timers.grace)
+				if epoch, _ := peer.epochs.current(); peer.ready && epoch != -1 {
+					peer.probe(&s.Conn, uint32(epoch), 0)
+				}
+				if peer.ready && time.Now().Sub(peer.ttlm) > s.timers.idle {
+					s.log.info("peer idle - session closed", append(peerAttrs(peer), "idle", s.timers.idle)...)
+					naddr := peer.naddr
+					s.reset(peer)
+					s.emitDown(peer, naddr, CloseTimeout, false)
 				}
 			}
 		}
+	}
+}
 
+// sendQueued sends a message handed over by sendMessage, which only happens
+// when its destination has no session.
+func (s *ServerConn) sendQueued(msg *message) error {
+	peer := s.sender(msg.addr)
+	if peer == nil {
+		return fmt.Errorf("%w %d", ErrUnknownPeer, msg.addr)
 	}
-exit:
-	s.open.setStat(statClose)
-	s.conn.Close()
-	for {
-		select {
-		case _, ok := <-s.ch.netRx:
-			if !ok {
-				s.err <- nil
-				s.ch.close()
-				return
-			}
-		case e, ok := <-s.ch.errNRx:
-			if ok {
-				s.err <- e
-				s.ch.close()
-				return
-			}
+	k := peer.tx.Load()
+	if k == nil {
+		return ErrNotReady
+	}
+	if e := peer.sendData(k, s.vaddr, msg, s.conn); e != nil {
+		return newError("sending data packet:", e)
+	}
+	return nil
+}
+
+// route delivers a received message to the user or relays it to its destination.
+func (s *ServerConn) route(msg *message) {
+	// Messages are routed in the worker of their source, which owns its counters
+	from := s.sender(msg.addr)
+	if from != nil {
+		if e := from.acl.allowMessage(msg); e != nil {
+			from.stats.drops[DropDenied]++
+			s.log.drop(DropDenied.String(), "message dropped", "vaddr", msg.addr, "dst", msg.dst, "err", e)
+			msg.release()
+			return
 		}
 	}
+	if msg.dst == s.vaddr {
+		s.deliver(msg)
+		return
+	}
+	defer msg.release()
+	if s.opts.RelayACL != nil && !s.opts.RelayACL(msg.addr, msg.dst) {
+		if from != nil {
+			from.stats.drops[DropDenied]++
+		}
+		s.log.drop("relay denied", "message dropped", "vaddr", msg.addr, "dst", msg.dst)
+		return
+	}
+	// The destination may belong to another worker, only its send key is used
+	peer := s.sender(msg.dst)
+	var k *sendKey
+	if peer != nil {
+		k = peer.tx.Load()
+	}
+	if k == nil {
+		if from != nil {
+			from.stats.drops[DropUnknownSource]++
+		}
+		s.log.drop("relay not ready", "message dropped", "vaddr", msg.addr, "dst", msg.dst)
+		return
+	}
+	src := msg.addr
+	msg.addr = msg.dst
+	if e := peer.sendData(k, src, msg, s.conn); e != nil {
+		s.log.warn("relay failed", append(peerAttrs(peer), "src", src, "err", e)...)
+	}
 }
 
-func Listen(laddr *LocalAddr, raddrs []*RemoteAddr) (*ServerConn, error) {
+// control handles the control requests of a peer that involve other peers.
+func (s *ServerConn) control(p *peer, c *ctrlmessage) error {
+	if c.isSet(Close) {
+		s.closed(p, CloseReason(c.data))
+		return nil
+	}
+	if c.isSet(Rendezvous) {
+		return s.rendezvous(p, uint16(c.data))
+	}
+	return nil
+}
+
+// rendezvous introduces two peers to each other with the network address
+// observed by the server, so both can punch a direct session at the same time.
+// The target may belong to another worker, only its send key is used.
+func (s *ServerConn) rendezvous(p *peer, vaddr uint16) error {
+	target := s.sender(vaddr)
+	var k *sendKey
+	if target != nil {
+		k = target.tx.Load()
+	}
+	if k == nil || p.acl.allowMessage(&message{dst: vaddr}) != nil ||
+		(s.opts.RelayACL != nil && !s.opts.RelayACL(p.vaddr, vaddr)) {
+		epoch, _ := p.epochs.current()
+		return p.sendCtrl(&s.Conn, uint32(epoch), Introduce, endpointData(vaddr, nil))
+	}
+	if e := target.sendCtrlKey(&s.Conn, k, Introduce, endpointData(p.vaddr, p.naddr)); e != nil {
+		return e
+	}
+	epoch, _ := p.epochs.current()
+	return p.sendCtrl(&s.Conn, uint32(epoch), Introduce, endpointData(vaddr, k.naddr))
+}
+
+func Listen(laddr *LocalAddr, raddrs []*RemoteAddr, opts *ServerOpts) (*ServerConn, error) {
 
 	if laddr.PrivateKey == nil {
 		return nil, fmt.Errorf("private key not present")
@@ -119,34 +272,67 @@ func Listen(laddr *LocalAddr, raddrs []*RemoteAddr) (*ServerConn, error) {
 		return nil, fmt.Errorf("network address not found")
 	}
 
-	conn, err := net.ListenUDP("udp4", laddr.NetworkAddress)
+	if opts == nil {
+		opts = &ServerOpts{}
+	}
+	if opts.IdleTimeout < 0 || opts.PrevEpochGrace < 0 {
+		return nil, fmt.Errorf("negative session timer")
+	}
+	timers := timers{
+		idle:  opts.IdleTimeout,
+		grace: opts.PrevEpochGrace,
+	}
+	if timers.idle == 0 {
+		timers.idle = defaultIdleTimeout
+	}
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("negative number of workers")
+	}
+	workers := max(opts.Workers, 1)
+	queue, err := queuePolicy(opts.RecvQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	conns, err := listenServer(laddr.NetworkAddress, workers, opts.ReusePort)
 	if err != nil {
 		return nil, err
 	}
 
 	server := ServerConn{
+		conns:  conns,
+		opts:   opts,
+		timers: timers,
 		Conn: Conn{
 			vaddr:   laddr.VirtualAddress,
-			conn:    conn,
+			conn:    conns[0],
+			writer:  newPktWriter(conns[0]),
 			private: laddr.PrivateKey,
 			err:     make(chan error),
+			log:     logger{l: opts.Logger},
+			queue:   queue,
 		},
-		peerMap: make(map[uint16]*peer),
 	}
+	server.ch.init(nil, nil, queue.Size)
+	server.ch.errNRx = make(chan error, len(conns))
+	server.workers = make([]*worker, workers)
+	for i := range server.workers {
+		server.workers[i] = newWorker()
+	}
+	// The first worker runs the calls of the connection
+	server.workers[0].calls = server.ch.calls
 
 	for _, addr := range raddrs {
 		if addr.PublicKey == nil {
 			continue
 		}
-		server.peerMap[addr.VirtualAddress] = &peer{
-			vaddr:   addr.VirtualAddress,
-			pubkey:  addr.PublicKey,
-			hmackey: addr.SharedHmacKey,
-		}
-		server.peerMap[addr.VirtualAddress].epochs.init()
+		p := newPeer(addr)
+		server.worker(addr.VirtualAddress).peerMap[addr.VirtualAddress] = p
+		server.addSender(p)
 	}
 
-	server.ch.init(conn, nil)
+	server.onData = server.route
+	server.onCtrl = server.control
 	server.open.setStat(statOpen)
 	go server.serve()
 	return &server, nil
@@ -154,6 +340,7 @@ func Listen(laddr *LocalAddr, raddrs []*RemoteAddr) (*ServerConn, error) {
 
 func (s *ServerConn) Close() {
 	if s != nil && s.open.isOpen() {
+		s.ch.stop()
 		s.ch.exit <- true
 		<-s.err
 	}
@@ -161,22 +348,69 @@ func (s *ServerConn) Close() {
 
 func (s *ServerConn) RecvFrom() ([]byte, uint16, error) {
 	if s == nil || !s.open.isOpen() {
-		return nil, 0, fmt.Errorf("server closed")
+		return nil, 0, ErrClosed
 	}
-	msg := <-s.ch.userRx
-	if msg == nil {
-		return nil, 0, fmt.Errorf("server closed")
+	return recvCopy(<-s.ch.userRx)
+}
+
+// RecvInto copies the next message into b and returns its size and source,
+// without allocating. If b is too small the message is truncated and
+// io.ErrShortBuffer is returned.
+func (s *ServerConn) RecvInto(b []byte) (int, uint16, error) {
+	if s == nil || !s.open.isOpen() {
+		return 0, 0, ErrClosed
 	}
-	return msg.buff, msg.addr, nil
+	return recvInto(<-s.ch.userRx, b)
 }
 
 func (s *ServerConn) SendTo(buff []byte, addr uint16) error {
 	if s == nil || !s.open.isOpen() {
-		return fmt.Errorf("server closed")
+		return ErrClosed
 	}
-	s.ch.userTx <- &message{
+	return s.sendMessage(message{
+		kind: typeData,
 		buff: buff,
 		addr: addr,
+	})
+}
+
+// SendBatchTo sends the messages of buffs to addr in order and returns how
+// many were sent. Equal sized messages are written together with UDP
+// segmentation offload where the platform supports it.
+func (s *ServerConn) SendBatchTo(buffs [][]byte, addr uint16) (int, error) {
+	if s == nil || !s.open.isOpen() {
+		return 0, ErrClosed
+	}
+	return s.sendMessages(buffs, addr)
+}
+
+// OpenStream opens a reliable stream to the peer with virtual address addr.
+func (s *ServerConn) OpenStream(addr uint16) (*Stream, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return s.streams().open(addr)
+}
+
+// AcceptStream waits for a stream opened by any peer.
+func (s *ServerConn) AcceptStream() (*Stream, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
 	}
-	return <-s.ch.errUTx
+	return s.streams().acceptStream()
+}
+
+// Listen binds a logical channel identified by port. Messages sent by the peers
+// to that port are queued in the returned channel instead of RecvFrom.
+func (s *ServerConn) Listen(port uint16) (*Channel, error) {
+	if s == nil || !s.open.isOpen() {
+		return nil, ErrClosed
+	}
+	return s.ports.bind(&s.Conn, port, nil)
+}
+
+// Denied returns the number of packets dropped by the peers ACLs.
+func (s *ServerConn) Denied() uint64 {
+	st, _ := s.Stats()
+	return st.Drops[DropDenied]
 }
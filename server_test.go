@@ -0,0 +1,61 @@
+package sudp
+
+import "testing"
+
+// Messages denied by the relay ACL are counted as drops of their source.
+func TestRelayACLDrops(t *testing.T) {
+	srv, clients, _ := newStar(t, 2, &ServerOpts{
+		Relay:    true,
+		RelayACL: func(src, dst uint16) bool { return src != 1 },
+	}, nil)
+	const n = 3
+	for range n {
+		if err := clients[0].SendTo([]byte("denied"), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := clients[1].SendTo([]byte("allowed"), 1); err != nil {
+		t.Fatal(err)
+	}
+	b, from, err := clients[0].RecvFrom()
+	if err != nil || string(b) != "allowed" || from != 2 {
+		t.Fatalf("RecvFrom = %q, %d, %v", b, from, err)
+	}
+	waitFor(t, "the denied messages", func() bool { return peerDrops(t, srv, 1, DropDenied) == n })
+}
+
+// Relayed messages to a destination without session are counted as drops of
+// their source.
+func TestRelayNotReadyDrops(t *testing.T) {
+	srv, clients, _ := newStar(t, 2, &ServerOpts{Relay: true}, nil)
+	clients[1].Close()
+	waitFor(t, "peer 2 to close", func() bool {
+		info, _, _ := srv.Peer(2)
+		return !info.Ready
+	})
+	for _, dst := range []uint16{2, 99} {
+		if err := clients[0].SendTo([]byte("nowhere"), dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the relay drops", func() bool { return peerDrops(t, srv, 1, DropUnknownSource) == 2 })
+}
+
+// The send key of a closed session is withdrawn with its keys.
+func TestKickWithdrawsSendKey(t *testing.T) {
+	srv, cli := newPair(t, nil, nil)
+	if err := cli.Send([]byte("ready")); err != nil {
+		t.Fatal(err)
+	}
+	recvAll(t, srv, 1)
+	p := srv.sender(1)
+	if p == nil || p.tx.Load() == nil {
+		t.Fatal("no send key for a ready peer")
+	}
+	if err := srv.Kick(1, CloseNormal); err != nil {
+		t.Fatal(err)
+	}
+	if k := p.tx.Load(); k != nil {
+		t.Fatalf("send key of epoch %d left after Kick", k.epoch)
+	}
+}
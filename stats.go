@@ -0,0 +1,224 @@
+package sudp
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+// DropReason classifies the received packets discarded by a connection.
+type DropReason int
+
+const (
+	DropMalformed     DropReason = iota // Truncated packet or invalid header fields
+	DropUnknownSource                   // Unknown virtual address, destination or endpoint
+	DropBadHMAC                         // Header HMAC does not match
+	DropOutOfTime                       // Timestamp outside the accepted window
+	DropBadSignature                    // Invalid signature of a handshake or control message
+	DropInvalidEpoch                    // Epoch not negotiated with the peer
+	DropDecrypt                         // Data that can not be decrypted
+	DropDenied                          // Rejected by an ACL
+	dropReasons
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropMalformed:
+		return "malformed"
+	case DropUnknownSource:
+		return "unknown source"
+	case DropBadHMAC:
+		return "bad hmac"
+	case DropOutOfTime:
+		return "out of time"
+	case DropBadSignature:
+		return "bad signature"
+	case DropInvalidEpoch:
+		return "invalid epoch"
+	case DropDecrypt:
+		return "decrypt failure"
+	case DropDenied:
+		return "denied"
+	}
+	return fmt.Sprintf("DropReason(%d)", int(r))
+}
+
+// Counters are the traffic counters of a connection or one of its peers.
+type Counters struct {
+	RxPackets           uint64
+	RxBytes             uint64
+	TxPackets           uint64
+	TxBytes             uint64
+	HandshakesInitiated uint64
+	HandshakesCompleted uint64
+	HandshakesFailed    uint64 // Invalid handshakes received and handshakes not answered
+	EpochRotations      uint64
+	Drops               map[DropReason]uint64
+	RecvDrops           uint64    // Messages not delivered to a full receive queue or an unbound or full channel, counted on the connection only
+	RTT                 Histogram // Round trip time samples
+	HandshakeLatency    Histogram // From the start of a handshake to its completion
+}
+
+type PeerStats struct {
+	VirtualAddress uint16
+	Counters
+}
+
+// Stats are the totals of a connection, including the drops not attributed to
+// any peer and the counters of the removed ones, and the counters of every peer.
+type Stats struct {
+	Counters
+	Peers []PeerStats
+}
+
+type counters struct {
+	rxPackets, rxBytes uint64
+	txPackets, txBytes uint64
+	hsInit, hsDone     uint64
+	hsFail, rotations  uint64
+	drops              [dropReasons]uint64
+	recvDrops          uint64
+	rtt, hsLatency     histogram
+}
+
+// txcounters count the packets sent to a peer, which may be sent from any
+// goroutine.
+type txcounters struct {
+	packets, bytes atomic.Uint64
+}
+
+func (t *txcounters) count(n int) {
+	t.packets.Add(1)
+	t.bytes.Add(uint64(n))
+}
+
+// counters returns the counters of p, including the packets sent.
+func (p *peer) counters() counters {
+	c := p.stats
+	c.txPackets += p.sent.packets.Load()
+	c.txBytes += p.sent.bytes.Load()
+	return c
+}
+
+func (c *counters) add(o *counters) {
+	c.rxPackets += o.rxPackets
+	c.rxBytes += o.rxBytes
+	c.txPackets += o.txPackets
+	c.txBytes += o.txBytes
+	c.hsInit += o.hsInit
+	c.hsDone += o.hsDone
+	c.hsFail += o.hsFail
+	c.rotations += o.rotations
+	for i := range c.drops {
+		c.drops[i] += o.drops[i]
+	}
+	c.recvDrops += o.recvDrops
+	c.rtt.add(&o.rtt)
+	c.hsLatency.add(&o.hsLatency)
+}
+
+func (c *counters) export() Counters {
+	e := Counters{
+		RxPackets:           c.rxPackets,
+		RxBytes:             c.rxBytes,
+		TxPackets:           c.txPackets,
+		TxBytes:             c.txBytes,
+		HandshakesInitiated: c.hsInit,
+		HandshakesCompleted: c.hsDone,
+		HandshakesFailed:    c.hsFail,
+		EpochRotations:      c.rotations,
+		RecvDrops:           c.recvDrops,
+		Drops:               make(map[DropReason]uint64),
+		RTT:                 c.rtt.export(),
+		HandshakeLatency:    c.hsLatency.export(),
+	}
+	for r, n := range c.drops {
+		if n > 0 {
+			e.Drops[DropReason(r)] = n
+		}
+	}
+	return e
+}
+
+// dropped counts a discarded packet, on p if the source peer is known.
+func (c *Conn) dropped(p *peer, e error) {
+	var d *DropError
+	if !errors.As(e, &d) {
+		return
+	}
+	if p != nil {
+		d.VirtualAddress = int(p.vaddr)
+		p.stats.drops[d.Reason]++
+	} else {
+		c.slock.Lock()
+		c.stats.drops[d.Reason]++
+		c.slock.Unlock()
+	}
+}
+
+func (c *Conn) collect(peers []*peer) Stats {
+	var (
+		st    Stats
+		total counters
+	)
+	for _, p := range peers {
+		st.add(p, &total)
+	}
+	c.finish(&st, &total)
+	return st
+}
+
+// add appends the counters of p to st and adds them to total, it is called
+// from the loop owning p.
+func (st *Stats) add(p *peer, total *counters) {
+	pc := p.counters()
+	total.add(&pc)
+	st.Peers = append(st.Peers, PeerStats{VirtualAddress: p.vaddr, Counters: pc.export()})
+}
+
+// finish adds the counters of the connection itself to total and exports it.
+func (c *Conn) finish(st *Stats, total *counters) {
+	c.slock.Lock()
+	total.add(&c.stats)
+	c.slock.Unlock()
+	slices.SortFunc(st.Peers, func(a, b PeerStats) int { return int(a.VirtualAddress) - int(b.VirtualAddress) })
+	st.Counters = total.export()
+}
+
+// Stats returns the counters of the server and its peers.
+func (s *ServerConn) Stats() (Stats, error) {
+	if s == nil || !s.open.isOpen() {
+		return Stats{}, ErrClosed
+	}
+	var (
+		st    Stats
+		total counters
+	)
+	if e := s.callAll(func(w *worker) {
+		for _, p := range w.peerMap {
+			st.add(p, &total)
+		}
+	}); e != nil {
+		return Stats{}, e
+	}
+	s.finish(&st, &total)
+	return st, nil
+}
+
+// Stats returns the counters of the connection, the server and the peers
+// registered with Punch.
+func (c *ClientConn) Stats() (Stats, error) {
+	if c == nil || !c.open.isOpen() {
+		return Stats{}, ErrClosed
+	}
+	var st Stats
+	e := c.call(func() {
+		peers := []*peer{c.server}
+		for _, p := range c.direct {
+			peers = append(peers, p)
+		}
+		st = c.collect(peers)
+	})
+	return st, e
+}
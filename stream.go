@@ -0,0 +1,800 @@
+package sudp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	streamHdrsz   = 4 + 1 + 1 + 2 + 4 + 4
+	streamMSS     = 1200
+	streamWindow  = 256 // In segments
+	streamMaxSack = 4
+	streamMaxRetx = 10
+	streamBacklog = 16
+	streamCwnd    = 16 // Initial congestion window
+	streamMinCwnd = 4
+	streamLinger  = 2 * time.Second
+)
+
+const (
+	segSyn uint8 = 1 << 0
+	segAck uint8 = 1 << 1
+	segFin uint8 = 1 << 2
+	segRst uint8 = 1 << 3
+)
+
+// sackBlock is a range [start, end) of segments received out of order.
+type sackBlock struct {
+	start uint32
+	end   uint32
+}
+
+type segment struct {
+	id    uint32
+	flags uint8
+	wnd   uint16
+	seq   uint32
+	ack   uint32
+	sack  []sackBlock
+	buff  []byte
+}
+
+func segmentLoad(b []byte) (*segment, error) {
+	if len(b) < streamHdrsz {
+		return nil, fmt.Errorf("invalid buffer size")
+	}
+	s := segment{
+		id:    binary.BigEndian.Uint32(b[0:]),
+		flags: b[4],
+		wnd:   binary.BigEndian.Uint16(b[6:]),
+		seq:   binary.BigEndian.Uint32(b[8:]),
+		ack:   binary.BigEndian.Uint32(b[12:]),
+	}
+	nsack := int(b[5])
+	if nsack > streamMaxSack || len(b) < streamHdrsz+8*nsack {
+		return nil, fmt.Errorf("invalid sack blocks")
+	}
+	b = b[streamHdrsz:]
+	for i := 0; i < nsack; i++ {
+		s.sack = append(s.sack, sackBlock{
+			start: binary.BigEndian.Uint32(b[0:]),
+			end:   binary.BigEndian.Uint32(b[4:]),
+		})
+		b = b[8:]
+	}
+	s.buff = b
+	return &s, nil
+}
+
+func (s *segment) dump() []byte {
+	b := make([]byte, streamHdrsz+8*len(s.sack)+len(s.buff))
+	binary.BigEndian.PutUint32(b[0:], s.id)
+	b[4] = s.flags
+	b[5] = uint8(len(s.sack))
+	binary.BigEndian.PutUint16(b[6:], s.wnd)
+	binary.BigEndian.PutUint32(b[8:], s.seq)
+	binary.BigEndian.PutUint32(b[12:], s.ack)
+	p := b[streamHdrsz:]
+	for _, blk := range s.sack {
+		binary.BigEndian.PutUint32(p[0:], blk.start)
+		binary.BigEndian.PutUint32(p[4:], blk.end)
+		p = p[8:]
+	}
+	copy(p, s.buff)
+	return b
+}
+
+// sequenced reports whether the segment consumes a sequence number.
+func (s *segment) sequenced() bool {
+	return len(s.buff) > 0 || s.flags&(segSyn|segFin) != 0
+}
+
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// StreamAddr identifies one end of a reliable stream.
+type StreamAddr struct {
+	VirtualAddress uint16
+	Stream         uint32
+}
+
+func (a *StreamAddr) Network() string {
+	return "sudp"
+}
+
+func (a *StreamAddr) String() string {
+	return fmt.Sprintf("%d/%d", a.VirtualAddress, a.Stream)
+}
+
+type outseg struct {
+	seg    *segment
+	sent   time.Time
+	retx   int
+	sacked bool
+	lost   bool
+	fast   bool
+}
+
+// Stream is a reliable, ordered byte stream multiplexed over a SUDP session.
+// It implements net.Conn.
+type Stream struct {
+	id    uint32
+	raddr uint16
+	mux   *streamMux
+	lock  sync.Mutex
+
+	// Send side
+	sndNxt  uint32
+	unacked []*outseg
+	sndBuf  []byte
+	rmtWnd  uint16
+	cwnd    int
+	cacc    int
+	ssthr   int
+	finQ    bool
+	finSent bool
+	finAckd bool
+	rtt     rttStats
+	rto     time.Duration
+	timer   *time.Timer
+
+	// Receive side
+	rcvNxt  uint32
+	ooo     map[uint32]*segment
+	rcvBuf  []byte
+	rcvFin  bool
+	lastWnd uint16
+
+	err       error
+	closed    bool
+	removed   bool
+	readEv    chan struct{}
+	writeEv   chan struct{}
+	rdeadline time.Time
+	wdeadline time.Time
+}
+
+func newStream(mux *streamMux, raddr uint16, id uint32) *Stream {
+	return &Stream{
+		id:      id,
+		raddr:   raddr,
+		mux:     mux,
+		rmtWnd:  streamWindow,
+		cwnd:    streamCwnd,
+		ssthr:   streamWindow,
+		rto:     rttInitial,
+		ooo:     make(map[uint32]*segment),
+		lastWnd: streamWindow,
+		readEv:  make(chan struct{}, 1),
+		writeEv: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) wakeup() {
+	notify(s.readEv)
+	notify(s.writeEv)
+}
+
+// wait blocks until ev is signaled, the deadline expires or the mux is closed.
+func (s *Stream) wait(ev chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ev:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.mux.done:
+		return nil
+	}
+}
+
+func (s *Stream) window() uint16 {
+	used := len(s.ooo) + (len(s.rcvBuf)+streamMSS-1)/streamMSS
+	if used >= streamWindow {
+		return 0
+	}
+	return uint16(streamWindow - used)
+}
+
+func (s *Stream) sackBlocks() []sackBlock {
+	var blocks []sackBlock
+	for seq := s.rcvNxt + 1; len(s.ooo) > 0 && seqLess(seq, s.rcvNxt+streamWindow); seq++ {
+		if _, ok := s.ooo[seq]; !ok {
+			continue
+		}
+		if n := len(blocks); n > 0 && blocks[n-1].end == seq {
+			blocks[n-1].end++
+			continue
+		}
+		if len(blocks) == streamMaxSack {
+			break
+		}
+		blocks = append(blocks, sackBlock{start: seq, end: seq + 1})
+	}
+	return blocks
+}
+
+// stamp returns a copy of seg carrying the current acknowledgement state.
+func (s *Stream) stamp(seg *segment) *segment {
+	out := *seg
+	out.id = s.id
+	out.ack = s.rcvNxt
+	out.flags |= segAck
+	out.wnd = s.window()
+	out.sack = s.sackBlocks()
+	s.lastWnd = out.wnd
+	return &out
+}
+
+func (s *Stream) ackSegment() *segment {
+	return s.stamp(&segment{seq: s.sndNxt})
+}
+
+func (s *Stream) inflight() int {
+	n := 0
+	for _, o := range s.unacked {
+		if !o.sacked && !o.lost {
+			n++
+		}
+	}
+	return n
+}
+
+// flush retransmits lost segments and moves buffered data into new segments
+// while the congestion and the remote receive windows allow it. A single
+// segment is always allowed to probe a closed window.
+func (s *Stream) flush() []*segment {
+	var out []*segment
+	inflight := s.inflight()
+	for _, o := range s.unacked {
+		if inflight >= s.cwnd {
+			break
+		}
+		if o.lost {
+			o.lost = false
+			o.sent = time.Now()
+			inflight++
+			out = append(out, s.stamp(o.seg))
+		}
+	}
+	for inflight < s.cwnd && len(s.unacked) < max(int(s.rmtWnd), 1) {
+		var seg *segment
+		if n := min(len(s.sndBuf), streamMSS); n > 0 {
+			seg = &segment{seq: s.sndNxt, buff: s.sndBuf[:n:n]}
+			s.sndBuf = s.sndBuf[n:]
+		} else if s.finQ && !s.finSent {
+			seg = &segment{seq: s.sndNxt, flags: segFin}
+			s.finSent = true
+		} else {
+			break
+		}
+		s.sndNxt++
+		s.unacked = append(s.unacked, &outseg{seg: seg, sent: time.Now()})
+		inflight++
+		out = append(out, s.stamp(seg))
+	}
+	if len(out) > 0 {
+		notify(s.writeEv)
+		s.arm()
+	}
+	return out
+}
+
+func (s *Stream) arm() {
+	if len(s.unacked) == 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		return
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.rto, s.onTimeout)
+	} else {
+		s.timer.Reset(s.rto)
+	}
+}
+
+func (s *Stream) onTimeout() {
+	s.lock.Lock()
+	if s.err != nil || len(s.unacked) == 0 {
+		s.lock.Unlock()
+		return
+	}
+	// Every segment not selectively acked is considered lost
+	for _, o := range s.unacked {
+		if o.sacked {
+			continue
+		}
+		// Probes of a closed window are retried until the reader makes room
+		if o.retx++; o.retx > streamMaxRetx && s.rmtWnd != 0 {
+			s.abort(fmt.Errorf("stream %d: %w", s.id, ErrStreamTimeout))
+			s.lock.Unlock()
+			s.mux.send(s.raddr, &segment{id: s.id, flags: segRst})
+			return
+		}
+		o.lost = true
+	}
+	s.ssthr = max(s.cwnd/2, streamMinCwnd)
+	s.cwnd = streamMinCwnd
+	s.rto = min(2*s.rto, rttMaxRTO)
+	out := s.flush()
+	s.arm()
+	s.lock.Unlock()
+	s.transmit(out)
+}
+
+func (s *Stream) transmit(segs []*segment) {
+	for _, seg := range segs {
+		if e := s.mux.send(s.raddr, seg); e != nil {
+			return
+		}
+	}
+}
+
+// abort terminates the stream with an error. Must be called with the lock held.
+func (s *Stream) abort(e error) {
+	if s.err == nil {
+		s.err = e
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.unacked = nil
+	s.wakeup()
+	s.remove(0)
+}
+
+func (s *Stream) remove(after time.Duration) {
+	if s.removed {
+		return
+	}
+	s.removed = true
+	if after == 0 {
+		s.mux.remove(s)
+		return
+	}
+	time.AfterFunc(after, func() { s.mux.remove(s) })
+}
+
+func (s *Stream) handleAck(seg *segment) []*segment {
+	var (
+		progress bool
+		sampled  bool
+	)
+	for len(s.unacked) > 0 && seqLess(s.unacked[0].seg.seq, seg.ack) {
+		o := s.unacked[0]
+		s.unacked = s.unacked[1:]
+		progress = true
+		if s.cwnd < s.ssthr {
+			s.cwnd++
+		} else if s.cacc++; s.cacc >= s.cwnd && s.cwnd < streamWindow {
+			s.cwnd++
+			s.cacc = 0
+		}
+		// Karn's algorithm, retransmitted segments are not sampled
+		if o.retx == 0 && !sampled {
+			s.rtt.update(time.Since(o.sent))
+			sampled = true
+		}
+		if o.seg.flags&segFin != 0 {
+			s.finAckd = true
+		}
+	}
+	var highest *outseg
+	for _, o := range s.unacked {
+		for _, blk := range seg.sack {
+			if !seqLess(o.seg.seq, blk.start) && seqLess(o.seg.seq, blk.end) {
+				o.sacked = true
+				highest = o
+			}
+		}
+	}
+	s.rmtWnd = seg.wnd
+	if progress {
+		s.rto = s.rtt.rto()
+		s.arm()
+	}
+	// Fast retransmit of holes below the highest selectively acked segment
+	var out []*segment
+	if highest != nil {
+		above := 0
+		for i := len(s.unacked) - 1; i >= 0; i-- {
+			o := s.unacked[i]
+			if o.sacked {
+				above++
+				continue
+			}
+			if above >= 3 && !o.fast && !o.lost && seqLess(o.seg.seq, highest.seg.seq) {
+				if len(out) == 0 {
+					s.ssthr = max(s.cwnd/2, streamMinCwnd)
+					s.cwnd = s.ssthr
+				}
+				o.fast = true
+				o.retx++
+				o.sent = time.Now()
+				out = append(out, s.stamp(o.seg))
+			}
+		}
+	}
+	return append(out, s.flush()...)
+}
+
+func (s *Stream) handleData(seg *segment) {
+	if !seg.sequenced() {
+		return
+	}
+	if seg.seq == s.rcvNxt && len(seg.buff) > 0 && s.window() == 0 {
+		// A probe of the closed window, acked without taking its data
+		return
+	}
+	if seg.seq != s.rcvNxt {
+		if seqLess(s.rcvNxt, seg.seq) && seqLess(seg.seq, s.rcvNxt+streamWindow) {
+			s.ooo[seg.seq] = seg
+		}
+		return
+	}
+	for {
+		s.rcvBuf = append(s.rcvBuf, seg.buff...)
+		if seg.flags&segFin != 0 {
+			s.rcvFin = true
+		}
+		s.rcvNxt++
+		next, ok := s.ooo[s.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(s.ooo, s.rcvNxt)
+		seg = next
+	}
+	notify(s.readEv)
+}
+
+func (s *Stream) input(seg *segment) {
+	s.lock.Lock()
+	if seg.flags&segRst != 0 {
+		if s.rcvFin && s.finAckd {
+			s.abort(io.EOF)
+		} else {
+			s.abort(fmt.Errorf("stream %d: %w", s.id, ErrStreamReset))
+		}
+		s.lock.Unlock()
+		return
+	}
+	var out []*segment
+	if seg.flags&segAck != 0 {
+		out = s.handleAck(seg)
+	}
+	s.handleData(seg)
+	if seg.sequenced() && len(out) == 0 {
+		out = append(out, s.ackSegment())
+	}
+	if s.rcvFin && s.finAckd {
+		s.remove(streamLinger)
+	}
+	s.lock.Unlock()
+	s.transmit(out)
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(s.rcvBuf) > 0 {
+			n := copy(b, s.rcvBuf)
+			s.rcvBuf = s.rcvBuf[n:]
+			var update *segment
+			if s.lastWnd == 0 && s.window() > 0 {
+				update = s.ackSegment()
+			}
+			s.lock.Unlock()
+			if update != nil {
+				s.mux.send(s.raddr, update)
+			}
+			return n, nil
+		}
+		if s.rcvFin {
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			e := s.err
+			s.lock.Unlock()
+			return 0, e
+		}
+		if s.mux.isClosed() {
+			s.lock.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := s.rdeadline
+		s.lock.Unlock()
+		if e := s.wait(s.readEv, deadline); e != nil {
+			return 0, e
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		s.lock.Lock()
+		if s.err != nil {
+			e := s.err
+			s.lock.Unlock()
+			return written, e
+		}
+		if s.closed || s.mux.isClosed() {
+			s.lock.Unlock()
+			return written, net.ErrClosed
+		}
+		if space := streamWindow*streamMSS - len(s.sndBuf); space > 0 {
+			n := min(space, len(b)-written)
+			s.sndBuf = append(s.sndBuf, b[written:written+n]...)
+			written += n
+		}
+		out := s.flush()
+		deadline := s.wdeadline
+		s.lock.Unlock()
+		s.transmit(out)
+		if written == len(b) {
+			return written, nil
+		}
+		if e := s.wait(s.writeEv, deadline); e != nil {
+			return written, e
+		}
+	}
+}
+
+// Close sends the pending data followed by a FIN. Reads are no longer possible
+// after Close.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return net.ErrClosed
+	}
+	s.closed = true
+	var out []*segment
+	if s.err == nil {
+		s.finQ = true
+		out = s.flush()
+	}
+	if s.rcvFin && s.finAckd {
+		s.remove(streamLinger)
+	}
+	s.wakeup()
+	s.lock.Unlock()
+	s.transmit(out)
+	return nil
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return &StreamAddr{VirtualAddress: s.mux.conn.vaddr, Stream: s.id}
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return &StreamAddr{VirtualAddress: s.raddr, Stream: s.id}
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.rdeadline = t
+	s.lock.Unlock()
+	notify(s.readEv)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.wdeadline = t
+	s.lock.Unlock()
+	notify(s.writeEv)
+	return nil
+}
+
+type streamKey struct {
+	addr uint16
+	id   uint32
+}
+
+// streamMux demultiplexes stream segments received by a connection.
+type streamMux struct {
+	conn    *Conn
+	lock    sync.Mutex
+	streams map[streamKey]*Stream
+	accept  chan *Stream
+	rx      chan *message
+	nextID  uint32
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newStreamMux(conn *Conn) *streamMux {
+	m := &streamMux{
+		conn:    conn,
+		streams: make(map[streamKey]*Stream),
+		accept:  make(chan *Stream, streamBacklog),
+		rx:      make(chan *message, streamWindow),
+		done:    make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *streamMux) run() {
+	for {
+		select {
+		case msg := <-m.rx:
+			m.dispatch(msg)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// input is called from the connection loop and never blocks. Segments that
+// do not fit are dropped and recovered by retransmission.
+func (m *streamMux) input(msg *message) {
+	select {
+	case m.rx <- msg:
+	default:
+	}
+}
+
+func (m *streamMux) dispatch(msg *message) {
+	seg, e := segmentLoad(msg.buff)
+	if e != nil {
+		return
+	}
+	key := streamKey{addr: msg.addr, id: seg.id}
+	m.lock.Lock()
+	st, ok := m.streams[key]
+	if !ok && seg.flags&segSyn != 0 && seg.seq == 0 {
+		st = newStream(m, msg.addr, seg.id)
+		select {
+		case m.accept <- st:
+			m.streams[key] = st
+			ok = true
+		default:
+		}
+	}
+	m.lock.Unlock()
+	if !ok {
+		if seg.flags&segRst == 0 {
+			m.send(msg.addr, &segment{id: seg.id, flags: segRst})
+		}
+		return
+	}
+	st.input(seg)
+}
+
+func (m *streamMux) send(addr uint16, seg *segment) error {
+	return m.conn.sendMessage(message{
+		kind: typeStream,
+		buff: seg.dump(),
+		addr: addr,
+	})
+}
+
+func (m *streamMux) remove(s *Stream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := streamKey{addr: s.raddr, id: s.id}
+	if m.streams[key] == s {
+		delete(m.streams, key)
+	}
+}
+
+func (m *streamMux) open(addr uint16) (*Stream, error) {
+	m.lock.Lock()
+	if m.isClosed() {
+		m.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	// Each side of a session allocates ids of a different parity
+	id := m.nextID << 1
+	if m.conn.vaddr > addr {
+		id |= 1
+	}
+	m.nextID++
+	st := newStream(m, addr, id)
+	m.streams[streamKey{addr: addr, id: id}] = st
+	m.lock.Unlock()
+
+	st.lock.Lock()
+	st.sndNxt = 1
+	st.unacked = append(st.unacked, &outseg{seg: &segment{flags: segSyn}, sent: time.Now()})
+	syn := st.stamp(st.unacked[0].seg)
+	st.arm()
+	st.lock.Unlock()
+	if e := m.send(addr, syn); e != nil {
+		st.lock.Lock()
+		st.abort(e)
+		st.lock.Unlock()
+		return nil, e
+	}
+	return st, nil
+}
+
+func (m *streamMux) acceptStream() (*Stream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *streamMux) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reset aborts the streams to the addresses matched, once the session that
+// carries them is lost.
+func (m *streamMux) reset(match func(addr uint16) bool) {
+	m.abort(match, ErrSessionLost)
+}
+
+func (m *streamMux) close() {
+	m.once.Do(func() {
+		close(m.done)
+		m.abort(allStreams, net.ErrClosed)
+	})
+}
+
+// abort terminates the streams to the addresses matched with e, they are
+// removed from the mux.
+func (m *streamMux) abort(match func(addr uint16) bool, e error) {
+	m.lock.Lock()
+	var streams []*Stream
+	for key, st := range m.streams {
+		if match(key.addr) {
+			streams = append(streams, st)
+		}
+	}
+	m.lock.Unlock()
+	for _, st := range streams {
+		st.lock.Lock()
+		st.abort(e)
+		st.lock.Unlock()
+	}
+}
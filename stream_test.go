@@ -0,0 +1,284 @@
+package sudp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyProxy relays the packets between a client and a server, dropping and
+// reordering the stream segments.
+type lossyProxy struct {
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	loss   float64 // Probability of dropping a segment
+	swap   float64 // Probability of holding a segment until the next one
+	lock   sync.Mutex
+	drops  int
+	swaps  int
+	ctrl   []byte // Last control packet of the client
+}
+
+func newLossyProxy(t testing.TB, server *net.UDPAddr, loss, swap float64) *lossyProxy {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &lossyProxy{conn: conn, server: server, loss: loss, swap: swap}
+	go p.run()
+	return p
+}
+
+func (p *lossyProxy) addr() *net.UDPAddr {
+	return p.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// lastCtrl returns the last control packet sent by the client.
+func (p *lossyProxy) lastCtrl() []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.ctrl
+}
+
+// replay sends a captured client packet to the server again.
+func (p *lossyProxy) replay(pkt []byte) {
+	p.conn.WriteToUDP(pkt, p.server)
+}
+
+func (p *lossyProxy) run() {
+	rnd := rand.New(rand.NewSource(1))
+	var client *net.UDPAddr
+	held := map[bool][]byte{}
+	b := make([]byte, pktbuffSize)
+	for {
+		n, from, err := p.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		toClient := from.Port == p.server.Port && from.IP.Equal(p.server.IP)
+		to := p.server
+		if toClient {
+			to = client
+		} else {
+			client = from
+		}
+		if to == nil {
+			continue
+		}
+		pkt := bytes.Clone(b[:n])
+		if !toClient && n >= hdrsz && pkt[1] == typeCtrlMessage {
+			p.lock.Lock()
+			p.ctrl = pkt
+			p.lock.Unlock()
+		}
+		if n >= hdrsz && pkt[1] == typeStream {
+			p.lock.Lock()
+			r := rnd.Float64()
+			switch {
+			case r < p.loss:
+				p.drops++
+				p.lock.Unlock()
+				continue
+			case r < p.loss+p.swap && held[toClient] == nil:
+				p.swaps++
+				held[toClient] = pkt
+				p.lock.Unlock()
+				continue
+			}
+			p.lock.Unlock()
+		}
+		p.conn.WriteToUDP(pkt, to)
+		if h := held[toClient]; h != nil {
+			held[toClient] = nil
+			p.conn.WriteToUDP(h, to)
+		}
+	}
+}
+
+// streamPair opens a stream from the client and accepts it in the server, the
+// client reaches the server through a lossy proxy.
+func streamPair(t *testing.T, loss, swap float64) (*ServerConn, *ClientConn, *Stream, *Stream, *lossyProxy) {
+	t.Helper()
+	skey, _ := GenerateKey()
+	ckey, _ := GenerateKey()
+	hmkey := []byte("test hmac key")
+	srv, err := Listen(&LocalAddr{VirtualAddress: 0, PrivateKey: skey, NetworkAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		[]*RemoteAddr{{VirtualAddress: 1, PublicKey: &ckey.PublicKey, SharedHmacKey: hmkey}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	proxy := newLossyProxy(t, srv.conns[0].LocalAddr().(*net.UDPAddr), loss, swap)
+	cli, err := Connect(&LocalAddr{VirtualAddress: 1, PrivateKey: ckey},
+		&RemoteAddr{VirtualAddress: 0, PublicKey: &skey.PublicKey, SharedHmacKey: hmkey, NetworkAddress: proxy.addr()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	accepted := make(chan *Stream, 1)
+	go func() {
+		st, err := srv.AcceptStream()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- st
+	}()
+	cs, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first segment makes the server accept the stream
+	if _, err := cs.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	var ss *Stream
+	select {
+	case ss = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not accepted")
+	}
+	if ss == nil {
+		t.FailNow()
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(ss, b); err != nil {
+		t.Fatal(err)
+	}
+	return srv, cli, cs, ss, proxy
+}
+
+func payload(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// transfer writes data to w and closes it, and returns what r reads until EOF.
+func transfer(t *testing.T, w, r *Stream, data []byte) []byte {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		errc <- err
+	}()
+	r.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %d of %d bytes: %v", len(got), len(data), err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestStreamTransfer(t *testing.T) {
+	_, _, cs, ss, _ := streamPair(t, 0, 0)
+	data := payload(1 << 20)
+	if got := transfer(t, cs, ss, data); !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes differing from the %d sent", len(got), len(data))
+	}
+}
+
+// Lost and reordered segments are recovered by retransmission and
+// selective acks, in both directions.
+func TestStreamLossReorder(t *testing.T) {
+	_, _, cs, ss, proxy := streamPair(t, 0.05, 0.1)
+	data := payload(512 << 10)
+	if got := transfer(t, cs, ss, data); !bytes.Equal(got, data) {
+		t.Fatalf("client to server: received %d bytes differing from the %d sent", len(got), len(data))
+	}
+	_, _, cs, ss, _ = streamPair(t, 0.05, 0.1)
+	if got := transfer(t, ss, cs, data); !bytes.Equal(got, data) {
+		t.Fatalf("server to client: received %d bytes differing from the %d sent", len(got), len(data))
+	}
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	if proxy.drops == 0 || proxy.swaps == 0 {
+		t.Errorf("proxy dropped %d and reordered %d segments", proxy.drops, proxy.swaps)
+	}
+}
+
+// A writer blocks while the reader does not make room in the window.
+func TestStreamWindow(t *testing.T) {
+	_, _, cs, ss, _ := streamPair(t, 0, 0)
+	data := payload(4 * streamWindow * streamMSS)
+	cs.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
+	n, err := cs.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %d, %v, want %v", n, err, os.ErrDeadlineExceeded)
+	}
+	if n == 0 || n >= len(data) {
+		t.Fatalf("wrote %d of %d bytes before the deadline", n, len(data))
+	}
+	cs.SetWriteDeadline(time.Time{})
+	if got := transfer(t, cs, ss, data[n:]); !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes differing from the %d sent", len(got), len(data))
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	_, _, cs, ss, _ := streamPair(t, 0, 0)
+	ss.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := ss.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	// The stream is still usable after the deadline
+	data := payload(1000)
+	if got := transfer(t, cs, ss, data); !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes differing from the %d sent", len(got), len(data))
+	}
+}
+
+// Segments of a stream unknown to the peer are answered with a reset.
+func TestStreamRST(t *testing.T) {
+	_, _, cs, ss, _ := streamPair(t, 0, 0)
+	ss.mux.remove(ss)
+	if _, err := cs.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cs.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("Read = %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := cs.Write([]byte("lost")); err == nil {
+		t.Fatal("Write succeeded after a reset")
+	}
+}
+
+// The streams of a session closed by the peer are reset and removed.
+func TestStreamSessionLost(t *testing.T) {
+	srv, cli, _, ss, _ := streamPair(t, 0, 0)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ss.Read(make([]byte, 1))
+		errc <- err
+	}()
+	cli.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrSessionLost) {
+			t.Fatalf("Read = %v, want %v", err, ErrSessionLost)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read blocked after the session was closed")
+	}
+	m := srv.streams()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.streams) != 0 {
+		t.Errorf("%d streams left in the mux", len(m.streams))
+	}
+}
@@ -0,0 +1,115 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newPair connects a client with virtual address 1 to a server with virtual
+// address 0 over the loopback, both are closed with the test.
+func newPair(t testing.TB, sopts *ServerOpts, copts *ClientOpts) (*ServerConn, *ClientConn) {
+	t.Helper()
+	srv, clients, _ := newStar(t, 1, sopts, copts)
+	return srv, clients[0]
+}
+
+// newStar connects n clients with virtual addresses 1 to n to a server with
+// virtual address 0 over the loopback, and returns the clients addresses as
+// known by the server. Every connection is closed with the test.
+func newStar(t testing.TB, n int, sopts *ServerOpts, copts *ClientOpts) (*ServerConn, []*ClientConn, []*RemoteAddr) {
+	t.Helper()
+	skey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmkey := []byte("test hmac key")
+	var (
+		locals  []*LocalAddr
+		remotes []*RemoteAddr
+	)
+	for vaddr := uint16(1); vaddr <= uint16(n); vaddr++ {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		locals = append(locals, &LocalAddr{VirtualAddress: vaddr, PrivateKey: key})
+		remotes = append(remotes, &RemoteAddr{VirtualAddress: vaddr, PublicKey: &key.PublicKey, SharedHmacKey: hmkey})
+	}
+	srv, err := Listen(&LocalAddr{VirtualAddress: 0, PrivateKey: skey, NetworkAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		remotes, sopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	server := &RemoteAddr{VirtualAddress: 0, PublicKey: &skey.PublicKey, SharedHmacKey: hmkey,
+		NetworkAddress: srv.conns[0].LocalAddr().(*net.UDPAddr)}
+	clients := make([]*ClientConn, n)
+	for i := range clients {
+		c, err := Connect(locals[i], server, copts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		clients[i] = c
+	}
+	return srv, clients, remotes
+}
+
+// recvAll reads n messages from the server, failing the test if they do not
+// arrive in time.
+func recvAll(t testing.TB, srv *ServerConn, n int) [][]byte {
+	t.Helper()
+	got := make(chan []byte)
+	go func() {
+		for range n {
+			b, _, err := srv.RecvFrom()
+			if err != nil {
+				close(got)
+				return
+			}
+			got <- b
+		}
+	}()
+	msgs := make([][]byte, 0, n)
+	timeout := time.After(5 * time.Second)
+	for len(msgs) < n {
+		select {
+		case b, ok := <-got:
+			if !ok {
+				t.Fatalf("receive closed after %d of %d messages", len(msgs), n)
+			}
+			msgs = append(msgs, b)
+		case <-timeout:
+			t.Fatalf("received %d of %d messages", len(msgs), n)
+		}
+	}
+	return msgs
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// peerDrops returns the drops of the server peer vaddr for reason.
+func peerDrops(t testing.TB, srv *ServerConn, vaddr uint16, reason DropReason) uint64 {
+	t.Helper()
+	st, err := srv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range st.Peers {
+		if p.VirtualAddress == vaddr {
+			return p.Drops[reason]
+		}
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package sudp
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultKeepAlive      = 500 * time.Millisecond
+	defaultIdleTimeout    = 5 * time.Second
+	defaultHandshakeRetry = 2 * time.Second
+	defaultEpochLifetime  = 30 * time.Second
+	defaultTries          = 4
+	minServerTick         = time.Millisecond
+)
+
+// timers are the validated session timers of a connection.
+type timers struct {
+	keepAlive time.Duration // Interval of keepalives and the control loop
+	idle      time.Duration // Silence before a session is considered lost
+	retry     time.Duration // Handshake retransmission
+	lifetime  time.Duration // Epoch rotation
+	grace     time.Duration // Previous epoch acceptance after a rotation, 0 until the next one
+}
+
+// newTimers fills the zero values with the defaults and verifies the
+// combination. Seconds given with the deprecated int options are used when
+// the duration is not set.
+func newTimers(keepAlive, idle, retry, lifetime, grace time.Duration, retrySecs, lifetimeSecs int) (timers, error) {
+	if retry == 0 && retrySecs > 0 {
+		retry = time.Duration(retrySecs) * time.Second
+	}
+	if lifetime == 0 && lifetimeSecs > 0 {
+		lifetime = time.Duration(lifetimeSecs) * time.Second
+	}
+	t := timers{
+		keepAlive: keepAlive,
+		idle:      idle,
+		retry:     retry,
+		lifetime:  lifetime,
+		grace:     grace,
+	}
+	if t.keepAlive < 0 || t.idle < 0 || t.retry < 0 || t.lifetime < 0 || t.grace < 0 {
+		return t, fmt.Errorf("negative session timer")
+	}
+	if t.keepAlive == 0 {
+		t.keepAlive = defaultKeepAlive
+	}
+	if t.idle == 0 {
+		t.idle = defaultIdleTimeout
+	}
+	if t.retry == 0 {
+		t.retry = defaultHandshakeRetry
+	}
+	if t.lifetime == 0 {
+		t.lifetime = defaultEpochLifetime
+	}
+	if t.keepAlive >= t.idle {
+		return t, fmt.Errorf("keepalive interval %v must be lower than idle timeout %v", t.keepAlive, t.idle)
+	}
+	if t.retry >= t.lifetime {
+		return t, fmt.Errorf("handshake retry %v must be lower than epoch lifetime %v", t.retry, t.lifetime)
+	}
+	if t.grace >= t.lifetime {
+		return t, fmt.Errorf("previous epoch grace %v must be lower than epoch lifetime %v", t.grace, t.lifetime)
+	}
+	return t, nil
+}
+
+// serverTick is the interval of the server checks of idle sessions, a quarter
+// of the idle timeout bounded to [1ms, 1s].
+func (t timers) serverTick() time.Duration {
+	return max(min(time.Second, t.idle/4), minServerTick)
+}
+
+// handshakeRetry is the retransmission timeout of the handshake with p: the
+// RTO of the peer doubled on every retry, bounded by the configured retry.
+func (t timers) handshakeRetry(p *peer) time.Duration {
+	if p.rtt.samples == 0 || p.handshake == nil || p.handshake.tries > 16 {
+		return t.retry
+	}
+	return min(p.rtt.rto()<<p.handshake.tries, t.retry)
+}
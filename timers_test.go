@@ -0,0 +1,56 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerTick(t *testing.T) {
+	for _, tt := range []struct {
+		idle, want time.Duration
+	}{
+		{3, minServerTick},
+		{time.Millisecond, minServerTick},
+		{100 * time.Millisecond, 25 * time.Millisecond},
+		{defaultIdleTimeout, time.Second},
+	} {
+		if got := (timers{idle: tt.idle}).serverTick(); got != tt.want {
+			t.Errorf("idle %v: tick %v, want %v", tt.idle, got, tt.want)
+		}
+	}
+}
+
+// A tiny idle timeout must not stop the server loop.
+func TestListenTinyIdle(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := Listen(&LocalAddr{PrivateKey: key, NetworkAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		nil, &ServerOpts{IdleTimeout: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * minServerTick)
+	if _, err := srv.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+}
+
+func TestNewTimers(t *testing.T) {
+	if _, err := newTimers(-1, 0, 0, 0, 0, 0, 0); err == nil {
+		t.Error("negative keepalive accepted")
+	}
+	if _, err := newTimers(time.Second, time.Second, 0, 0, 0, 0, 0); err == nil {
+		t.Error("keepalive equal to the idle timeout accepted")
+	}
+	tm, err := newTimers(0, 0, 0, 0, 0, 3, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.retry != 3*time.Second || tm.lifetime != time.Minute || tm.keepAlive != defaultKeepAlive {
+		t.Errorf("timers %+v", tm)
+	}
+}
@@ -3,8 +3,9 @@ package sudp
 import "fmt"
 
 const (
-	protocolVersion = 0x3
+	protocolVersion = 0x5
 
+	typeStream          = 0x05
 	typeData            = 0x04
 	typeCtrlMessage     = 0x03
 	typeServerHandshake = 0x02
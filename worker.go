@@ -0,0 +1,102 @@
+package sudp
+
+import (
+	"fmt"
+	"net"
+)
+
+// worker is a loop of the server, it owns the peers whose virtual address
+// maps to it. Packets are handed to the worker of their source, so the state
+// of a peer is only touched by a single goroutine.
+type worker struct {
+	peerMap map[uint16]*peer
+	netRx   chan *pktbuff
+	calls   chan func()
+}
+
+func newWorker() *worker {
+	return &worker{
+		peerMap: make(map[uint16]*peer),
+		netRx:   make(chan *pktbuff),
+		calls:   make(chan func()),
+	}
+}
+
+// worker returns the worker owning the peer with virtual address vaddr.
+func (s *ServerConn) worker(vaddr uint16) *worker {
+	return s.workers[int(vaddr)%len(s.workers)]
+}
+
+// callIn runs f in the loop of w.
+func (s *ServerConn) callIn(w *worker, f func()) error {
+	return s.callOn(w.calls, f)
+}
+
+// callPeer runs f in the worker owning vaddr.
+func (s *ServerConn) callPeer(vaddr uint16, f func(w *worker)) error {
+	w := s.worker(vaddr)
+	return s.callIn(w, func() { f(w) })
+}
+
+// callAll runs f in every worker, one after the other.
+func (s *ServerConn) callAll(f func(w *worker)) error {
+	for _, w := range s.workers {
+		if e := s.callIn(w, func() { f(w) }); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// receive reads the packets of conn and hands them to the workers until stop
+// is closed, the error that ends it is reported on errNRx.
+func (s *ServerConn) receive(conn *net.UDPConn, stop chan struct{}) {
+	r := newPktReader(conn, nil)
+	for {
+		pkts, e := r.recv()
+		if e != nil {
+			s.ch.errNRx <- e
+			return
+		}
+		for _, p := range pkts {
+			// The source is checked by the worker, malformed packets go to the first one
+			w := s.workers[0]
+			if p.size >= hdrsz {
+				src, _ := hdrSrcDst(p.buff)
+				w = s.worker(src)
+			}
+			select {
+			case w.netRx <- p:
+			case <-stop:
+				p.release()
+			}
+		}
+	}
+}
+
+// listenServer opens the sockets of a server, one per worker with reuse.
+func listenServer(addr *net.UDPAddr, workers int, reuse bool) ([]*net.UDPConn, error) {
+	if !reuse {
+		conn, e := net.ListenUDP("udp4", addr)
+		if e != nil {
+			return nil, e
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+	conns := make([]*net.UDPConn, 0, workers)
+	for range workers {
+		// A port chosen by the system is shared by the next sockets
+		if len(conns) == 1 {
+			addr = conns[0].LocalAddr().(*net.UDPAddr)
+		}
+		conn, e := listenReusePort(addr)
+		if e != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("reuse port: %w", e)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
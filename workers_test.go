@@ -0,0 +1,104 @@
+package sudp
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// Peers spread over several workers, sharing one socket or one per worker,
+// exchange messages with the server and through the relay.
+func TestWorkers(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reuse=%v", reuse), func(t *testing.T) {
+			if reuse && runtime.GOOS != "linux" {
+				t.Skip("SO_REUSEPORT sockets per worker are Linux only")
+			}
+			testWorkers(t, reuse)
+		})
+	}
+}
+
+func testWorkers(t *testing.T, reuse bool) {
+	const n = 6
+	srv, clients, _ := newStar(t, n, &ServerOpts{Workers: 3, ReusePort: reuse, Relay: true}, nil)
+	if got := len(srv.conns); reuse && got != 3 || !reuse && got != 1 {
+		t.Fatalf("%d sockets", got)
+	}
+	for i, c := range clients {
+		if err := c.Send([]byte(fmt.Sprint(i + 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, b := range recvAll(t, srv, n) {
+		var vaddr uint16
+		fmt.Sscan(string(b), &vaddr)
+		if vaddr < 1 || vaddr > n {
+			t.Fatalf("received %q", b)
+		}
+	}
+
+	for i := range clients {
+		if err := srv.SendTo([]byte("from server"), uint16(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range clients {
+		b, from, err := c.RecvFrom()
+		if err != nil || string(b) != "from server" || from != 0 {
+			t.Fatalf("client %d: RecvFrom = %q, %d, %v", i+1, b, from, err)
+		}
+	}
+
+	// Each client relays to the next, whose peer is mostly in another worker
+	for i, c := range clients {
+		if err := c.SendTo([]byte("relayed"), uint16((i+1)%n+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range clients {
+		b, from, err := c.RecvFrom()
+		if want := uint16((i+n-1)%n + 1); err != nil || string(b) != "relayed" || from != want {
+			t.Fatalf("client %d: RecvFrom = %q, %d, %v, want from %d", i+1, b, from, err, want)
+		}
+	}
+
+	peers, err := srv.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != n {
+		t.Fatalf("%d peers", len(peers))
+	}
+	for _, p := range peers {
+		if !p.Ready {
+			t.Fatalf("peer %d not ready", p.VirtualAddress)
+		}
+	}
+
+	if err := srv.RemovePeer(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := srv.Peer(3); ok {
+		t.Fatal("removed peer still listed")
+	}
+	if peers, _ := srv.Peers(); len(peers) != n-1 {
+		t.Fatalf("%d peers after the removal", len(peers))
+	}
+	if err := srv.SendTo([]byte("gone"), 3); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("SendTo a removed peer = %v", err)
+	}
+	if err := srv.RemovePeer(3); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("second RemovePeer = %v", err)
+	}
+	// The other workers keep serving their peers
+	for _, vaddr := range []uint16{1, 2, 4, 5, 6} {
+		if err := srv.SendTo([]byte("still up"), vaddr); err != nil {
+			t.Fatal(err)
+		}
+		if b, _, err := clients[vaddr-1].RecvFrom(); err != nil || string(b) != "still up" {
+			t.Fatalf("client %d: RecvFrom = %q, %v", vaddr, b, err)
+		}
+	}
+}